@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	// ageFileSuffix is appended to `<id>.env` for age-encrypted environment files.
+	ageFileSuffix = ".age"
+
+	// ageIdentityFile and ageRecipientsFile are looked up in the configuration
+	// directory. The identity decrypts `<id>.env.age` files; the recipients file
+	// lists (one per line) everyone `setnv encrypt` and `setnv edit` encrypt to.
+	ageIdentityFile   = "identity"
+	ageRecipientsFile = "recipients"
+)
+
+// loadAgeIdentities reads the age identities used to decrypt `.env.age` files.
+// SETNV_AGE_IDENTITY may hold either the path to an identity file or an
+// `AGE-SECRET-KEY-...` value; otherwise <config dir>/identity is used.
+func loadAgeIdentities() ([]age.Identity, error) {
+	identity := os.Getenv("SETNV_AGE_IDENTITY")
+	if strings.HasPrefix(identity, "AGE-SECRET-KEY-") {
+		return age.ParseIdentities(strings.NewReader(identity))
+	}
+
+	identityPath := identity
+	if identityPath == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		identityPath = filepath.Join(dir, ageIdentityFile)
+	}
+
+	f, err := os.Open(identityPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read age identity (set SETNV_AGE_IDENTITY or create '%s'): %w", identityPath, err)
+	}
+	defer f.Close()
+
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse age identity '%s': %w", identityPath, err)
+	}
+	return identities, nil
+}
+
+// loadAgeRecipients collects the recipients that environment files are
+// encrypted to: the given `-r` recipients, every entry in
+// <config dir>/recipients, and the recipient of the local identity, so the
+// file can always be decrypted again by whoever encrypted it.
+func loadAgeRecipients(extra []string) ([]age.Recipient, error) {
+	var lines []string
+	lines = append(lines, extra...)
+
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, ageRecipientsFile)); err == nil {
+		lines = append(lines, string(content))
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read age recipients file: %w", err)
+	}
+
+	if identities, err := loadAgeIdentities(); err == nil {
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				lines = append(lines, x25519.Recipient().String())
+			}
+		}
+	}
+
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no age recipients: pass -r <recipient>, create '%s' or '%s'", filepath.Join(dir, ageRecipientsFile), filepath.Join(dir, ageIdentityFile))
+	}
+	return age.ParseRecipients(strings.NewReader(strings.Join(lines, "\n")))
+}
+
+// decryptAgeFile decrypts the age file at path, which may be binary or
+// ASCII-armored, and returns the plaintext.
+func decryptAgeFile(path string) ([]byte, error) {
+	identities, err := loadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	in := bufio.NewReader(f)
+	var src io.Reader = in
+	if start, _ := in.Peek(len(armor.Header)); string(start) == armor.Header {
+		src = armor.NewReader(in)
+	}
+
+	plaintext, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt '%s': %w", path, err)
+	}
+	return io.ReadAll(plaintext)
+}
+
+// writeAgeFile encrypts plaintext to recipients and writes it ASCII-armored to
+// path, so that the file stays readable by git tooling. The file is replaced
+// atomically.
+func writeAgeFile(path string, plaintext []byte, recipients []age.Recipient) error {
+	var buf bytes.Buffer
+	armorWriter := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armorWriter, recipients...)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := armorWriter.Close(); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// parseRecipientArgs splits `setnv encrypt|edit` arguments into the ID and
+// any `-r <recipient>` options.
+func parseRecipientArgs(args []string) (string, []string, error) {
+	var envID string
+	var recipients []string
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-r" || args[i] == "--recipient":
+			if i+1 >= len(args) {
+				return "", nil, fmt.Errorf("option %s requires a recipient", args[i])
+			}
+			i++
+			recipients = append(recipients, args[i])
+		case strings.HasPrefix(args[i], "-"):
+			return "", nil, fmt.Errorf("unknown option: %s", args[i])
+		case envID == "":
+			envID = args[i]
+		default:
+			return "", nil, fmt.Errorf("unexpected argument: %s", args[i])
+		}
+	}
+	if envID == "" {
+		return "", nil, fmt.Errorf("missing <id>")
+	}
+	return envID, recipients, nil
+}
+
+// runEncryptCommand implements `setnv encrypt <id> [-r <recipient>]...`:
+// it encrypts `<id>.env` to `<id>.env.age` next to it.
+func runEncryptCommand(args []string) error {
+	envID, extraRecipients, err := parseRecipientArgs(args)
+	if err != nil {
+		return err
+	}
+	envFilePath, err := findEnvFile(envID)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(envFilePath, ageFileSuffix) {
+		return fmt.Errorf("'%s' is already encrypted; use 'setnv edit %s' to change it", envFilePath, envID)
+	}
+
+	recipients, err := loadAgeRecipients(extraRecipients)
+	if err != nil {
+		return err
+	}
+	plaintext, err := os.ReadFile(envFilePath)
+	if err != nil {
+		return err
+	}
+
+	encryptedPath := envFilePath + ageFileSuffix
+	if err := writeAgeFile(encryptedPath, plaintext, recipients); err != nil {
+		return fmt.Errorf("could not write '%s': %w", encryptedPath, err)
+	}
+	fmt.Fprintf(os.Stderr, " » setnv: Encrypted '%s' to '%s' for %d recipient(s).\n", envFilePath, encryptedPath, len(recipients))
+	fmt.Fprintf(os.Stderr, " » setnv: '%s' still exists and takes precedence; remove it once you have verified the encrypted file.\n", envFilePath)
+	return nil
+}
+
+// runEditCommand implements `setnv edit <id> [-r <recipient>]...`: it decrypts
+// `<id>.env.age` into a private temporary file, opens it in $VISUAL or $EDITOR,
+// and re-encrypts the result. Plaintext files are edited in place. Like secret
+// files, the temporary file is preferably on a tmpfs (see secretFilesBaseDir),
+// so that the plaintext never reaches a disk.
+func runEditCommand(args []string) error {
+	envID, extraRecipients, err := parseRecipientArgs(args)
+	if err != nil {
+		return err
+	}
+	envFilePath, err := findEnvFile(envID)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(envFilePath, ageFileSuffix) {
+		return runEditor(envFilePath)
+	}
+
+	recipients, err := loadAgeRecipients(extraRecipients)
+	if err != nil {
+		return err
+	}
+	plaintext, err := decryptAgeFile(envFilePath)
+	if err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(secretFilesBaseDir(), "setnv-edit-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, filepath.Base(strings.TrimSuffix(envFilePath, ageFileSuffix)))
+	if err := os.WriteFile(tmpPath, plaintext, 0600); err != nil {
+		return err
+	}
+	if err := runEditor(tmpPath); err != nil {
+		return err
+	}
+
+	edited, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(edited, plaintext) {
+		fmt.Fprintf(os.Stderr, " » setnv: No changes made to '%s'.\n", envFilePath)
+		return nil
+	}
+	if err := writeAgeFile(envFilePath, edited, recipients); err != nil {
+		return fmt.Errorf("could not write '%s': %w", envFilePath, err)
+	}
+	fmt.Fprintf(os.Stderr, " » setnv: Re-encrypted '%s' for %d recipient(s).\n", envFilePath, len(recipients))
+	return nil
+}
+
+// runEditor opens path in the user's editor ($VISUAL, then $EDITOR, then vi)
+// and waits for it to exit. The editor value may include arguments.
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	cmd := exec.Command(defaultShell, "-c", editor+` "$1"`, "setnv-edit", path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("editor '%s' failed: %w", editor, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// setupAgeConfigDir points SETNV_CONFIG_DIR at a temporary directory holding
+// a freshly generated age identity, and returns the directory and identity.
+func setupAgeConfigDir(t *testing.T) (string, *age.X25519Identity) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SETNV_CONFIG_DIR", dir)
+	t.Setenv("SETNV_AGE_IDENTITY", "")
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate age identity: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ageIdentityFile), []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write age identity: %v", err)
+	}
+	return dir, identity
+}
+
+// TestParseAgeEncryptedEnvFile checks that `.env.age` files are found and
+// transparently decrypted before parsing.
+func TestParseAgeEncryptedEnvFile(t *testing.T) {
+	dir, _ := setupAgeConfigDir(t)
+
+	recipients, err := loadAgeRecipients(nil)
+	if err != nil {
+		t.Fatalf("loadAgeRecipients returned error: %v", err)
+	}
+	encryptedPath := filepath.Join(dir, "setnv-age-test.env"+ageFileSuffix)
+	if err := writeAgeFile(encryptedPath, []byte("HOST=db.internal\nURL=postgres://$HOST/app\n"), recipients); err != nil {
+		t.Fatalf("writeAgeFile returned error: %v", err)
+	}
+
+	envFilePath, err := findEnvFile("setnv-age-test")
+	if err != nil {
+		t.Fatalf("findEnvFile returned error: %v", err)
+	}
+	if envFilePath != encryptedPath {
+		t.Fatalf("Expected findEnvFile to return %q, Got %q", encryptedPath, envFilePath)
+	}
+
+	actualMap, err := parseEnvFile(envFilePath, defaultCommandExecutor, map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{"HOST": "db.internal", "URL": "postgres://db.internal/app"}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+}
+
+// TestAgeIdentityFromEnvironment checks that SETNV_AGE_IDENTITY may hold the
+// secret key itself, and that a wrong identity fails to decrypt.
+func TestAgeIdentityFromEnvironment(t *testing.T) {
+	dir, identity := setupAgeConfigDir(t)
+
+	encryptedPath := filepath.Join(dir, "secrets.env"+ageFileSuffix)
+	if err := writeAgeFile(encryptedPath, []byte("TOKEN=abc\n"), []age.Recipient{identity.Recipient()}); err != nil {
+		t.Fatalf("writeAgeFile returned error: %v", err)
+	}
+
+	t.Setenv("SETNV_AGE_IDENTITY", identity.String())
+	plaintext, err := decryptAgeFile(encryptedPath)
+	if err != nil || string(plaintext) != "TOKEN=abc\n" {
+		t.Fatalf("Expected decrypted plaintext, Got %q (error: %v)", plaintext, err)
+	}
+
+	other, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate age identity: %v", err)
+	}
+	t.Setenv("SETNV_AGE_IDENTITY", other.String())
+	if _, err := decryptAgeFile(encryptedPath); err == nil || !strings.Contains(err.Error(), "could not decrypt") {
+		t.Errorf("Expected a decryption error with the wrong identity, Got: %v", err)
+	}
+}
+
+// TestFindEnvFilePrefersPlaintext checks that `<id>.env` wins over `<id>.env.age`
+// in the same location.
+func TestFindEnvFilePrefersPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SETNV_CONFIG_DIR", dir)
+	for _, name := range envFileNames("setnv-find-test") {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("A=1\n"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	envFilePath, err := findEnvFile("setnv-find-test")
+	if err != nil {
+		t.Fatalf("findEnvFile returned error: %v", err)
+	}
+	if expected := filepath.Join(dir, "setnv-find-test.env"); envFilePath != expected {
+		t.Errorf("Expected %q, Got %q", expected, envFilePath)
+	}
+
+	if _, err := findEnvFile("setnv-missing-test"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a not found error, Got: %v", err)
+	}
+}
+
+// TestRunEditCommand checks that `setnv edit` decrypts into the private
+// runtime directory rather than the disk-backed temporary directory, and
+// re-encrypts the edited file.
+func TestRunEditCommand(t *testing.T) {
+	dir, _ := setupAgeConfigDir(t)
+	runtimeDir := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	recipients, err := loadAgeRecipients(nil)
+	if err != nil {
+		t.Fatalf("loadAgeRecipients returned error: %v", err)
+	}
+	encryptedPath := filepath.Join(dir, "setnv-edit-test.env"+ageFileSuffix)
+	if err := writeAgeFile(encryptedPath, []byte("HOST=db.internal\n"), recipients); err != nil {
+		t.Fatalf("writeAgeFile returned error: %v", err)
+	}
+	editedPathFile := filepath.Join(t.TempDir(), "edited-path")
+	editor := filepath.Join(t.TempDir(), "editor.sh")
+	if err := ioutil.WriteFile(editor, []byte("#!/bin/sh\necho \"$1\" > "+editedPathFile+"\necho PORT=5432 >> \"$1\"\n"), 0700); err != nil {
+		t.Fatalf("Failed to write editor: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", editor)
+
+	if err := runEditCommand([]string{"setnv-edit-test"}); err != nil {
+		t.Fatalf("runEditCommand returned error: %v", err)
+	}
+	editedPath, err := ioutil.ReadFile(editedPathFile)
+	if err != nil {
+		t.Fatalf("The editor did not run: %v", err)
+	}
+	if !strings.HasPrefix(string(editedPath), runtimeDir+string(filepath.Separator)) {
+		t.Errorf("Expected the plaintext in %s, Got %s", runtimeDir, editedPath)
+	}
+	plaintext, err := decryptAgeFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("decryptAgeFile returned error: %v", err)
+	}
+	if expected := "HOST=db.internal\nPORT=5432\n"; string(plaintext) != expected {
+		t.Errorf("Expected %q, Got %q", expected, plaintext)
+	}
+}
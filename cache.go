@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+)
+
+// cacheFileSuffix is the extension of the files in the cache directory.
+const cacheFileSuffix = ".age"
+
+// secretCache is the opt-in on-disk cache of substitution results, used for
+// entries with a `# @cache <ttl>` directive:
+//
+//	# @cache 8h
+//	DB_PASS=$(gopass show prod/db)
+//
+// Entries are keyed by the command or secret reference, the variables it
+// depends on (see envKey and secretMemoKey) and the working directory it is
+// resolved in, and encrypted to the local age identity (see
+// loadAgeIdentities), so cached secrets are no more exposed than `.env.age`
+// files. File names are hashes of the keys, which keeps commands and secret
+// paths private as well. The modification time of a file is set to when its
+// entry expires, and expired entries are removed whenever an entry is cached,
+// so that secrets do not stay on disk past their TTL.
+type secretCache struct {
+	dir string
+
+	once       sync.Once
+	identities []age.Identity
+	recipients []age.Recipient
+	err        error // Why the cache cannot be used, if it cannot.
+}
+
+// cacheEntry is the encrypted content of a cache file.
+type cacheEntry struct {
+	Key     string    `json:"key"`
+	Value   string    `json:"value"`
+	Expires time.Time `json:"expires"`
+}
+
+func newSecretCache(dir string) *secretCache {
+	return &secretCache{dir: dir}
+}
+
+// cacheDir returns the cache directory: SETNV_CACHE_DIR if set, otherwise
+// `setnv` in the user's cache directory (e.g., ~/.cache/setnv).
+func cacheDir() (string, error) {
+	if dir := os.Getenv("SETNV_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine the user cache directory: %w", err)
+	}
+	return filepath.Join(userCacheDir, "setnv"), nil
+}
+
+// load reads the age identity the cache is encrypted with, once.
+func (c *secretCache) load() error {
+	c.once.Do(func() {
+		if c.err != nil {
+			return // The cache directory is unknown.
+		}
+		identities, err := loadAgeIdentities()
+		if err != nil {
+			c.err = err
+			return
+		}
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				c.recipients = append(c.recipients, x25519.Recipient())
+			}
+		}
+		if len(c.recipients) == 0 {
+			c.err = fmt.Errorf("no X25519 age identity to encrypt the cache with")
+			return
+		}
+		c.identities = identities
+	})
+	return c.err
+}
+
+// path returns the file caching key.
+func (c *secretCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+// get returns the cached value for key and when it expires. Expired and
+// unreadable entries are removed and reported as missing.
+func (c *secretCache) get(key string) (string, time.Time, bool) {
+	if c.load() != nil {
+		return "", time.Time{}, false
+	}
+	path := c.path(key)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	defer f.Close()
+
+	var entry cacheEntry
+	plaintext, err := age.Decrypt(f, c.identities...)
+	if err == nil {
+		err = json.NewDecoder(plaintext).Decode(&entry)
+	}
+	if err != nil || entry.Key != key || time.Now().After(entry.Expires) {
+		os.Remove(path)
+		return "", time.Time{}, false
+	}
+	return entry.Value, entry.Expires, true
+}
+
+// put caches value for key until ttl has passed, and removes the entries that
+// have expired.
+func (c *secretCache) put(key, value string, ttl time.Duration) error {
+	if err := c.load(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	c.removeExpired()
+	expires := time.Now().Add(ttl)
+
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, c.recipients...)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(w).Encode(cacheEntry{Key: key, Value: value, Expires: expires}); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, &buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), time.Now(), expires); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(key))
+}
+
+// removeExpired removes the entries whose modification time, which put sets
+// to their expiry, has passed. Failures are ignored; get still checks the
+// expiry of every entry it reads.
+func (c *secretCache) removeExpired() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(now) {
+			os.Remove(filepath.Join(c.dir, entry.Name()))
+		}
+	}
+}
+
+// clear removes every cached entry and returns how many there were.
+func (c *secretCache) clear() (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// withCache returns the cached output for memoKey if the entry has a
+// `# @cache` TTL and a valid cache entry exists. Otherwise it calls run and
+// caches a successful result. Hits and misses are reported on diag.
+//
+// Entries are only shared by invocations from the same working directory, as
+// memoKey only covers the variables (see envKey and secretMemoKey).
+func (r *resolver) withCache(memoKey, what, key string, lineNum int, envFilePath string, opts entryOptions, diag io.Writer, run func() (string, error)) (string, error) {
+	if r.cache == nil || opts.cacheTTL == 0 {
+		return run()
+	}
+	if err := r.cache.load(); err != nil {
+		fmt.Fprintf(diag, " » setnv: Warning: Cache disabled for variable '%s' on line %d in '%s': %v.\n", key, lineNum, envFilePath, err)
+		return run()
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(diag, " » setnv: Warning: Cache disabled for variable '%s' on line %d in '%s': %v.\n", key, lineNum, envFilePath, err)
+		return run()
+	}
+	memoKey += "|dir:" + wd
+
+	if output, expires, ok := r.cache.get(memoKey); ok {
+		fmt.Fprintf(diag, " » setnv: Cache hit for %s (variable '%s' on line %d in '%s'), valid for %s.\n", what, key, lineNum, envFilePath, time.Until(expires).Round(time.Second))
+		return output, nil
+	}
+	output, err := run()
+	if err != nil {
+		return "", err
+	}
+	if err := r.cache.put(memoKey, output, opts.cacheTTL); err != nil {
+		fmt.Fprintf(diag, " » setnv: Warning: Could not cache %s for variable '%s' on line %d in '%s': %v.\n", what, key, lineNum, envFilePath, err)
+	} else {
+		fmt.Fprintf(diag, " » setnv: Cache miss for %s (variable '%s' on line %d in '%s'), cached for %s.\n", what, key, lineNum, envFilePath, opts.cacheTTL)
+	}
+	return output, nil
+}
+
+// runCacheCommand implements `setnv cache clear`.
+func runCacheCommand(args []string) error {
+	if len(args) != 1 || args[0] != "clear" {
+		return fmt.Errorf("usage: setnv cache clear")
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	removed, err := newSecretCache(dir).clear()
+	if err != nil {
+		return fmt.Errorf("could not clear the cache in '%s': %w", dir, err)
+	}
+	fmt.Fprintf(os.Stderr, " » setnv: Removed %d cached entries from '%s'.\n", removed, dir)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestSecretCache checks that `# @cache` results are reused by later resolvers
+// (i.e., later invocations), are encrypted on disk, and are only used while valid.
+func TestSecretCache(t *testing.T) {
+	setupAgeConfigDir(t)
+	cacheDirPath := t.TempDir()
+	t.Setenv("SETNV_CACHE_DIR", cacheDirPath)
+
+	envFile := filepath.Join(t.TempDir(), "cached.env")
+	envContent := "# @cache 1h\nCACHED=$(echo top-secret)\nUNCACHED=$(echo plain)\n"
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	executor, count := countingCommandExecutor()
+	for i := 0; i < 2; i++ {
+		r := newResolver(executor)
+		r.cache = newSecretCache(cacheDirPath)
+		actualMap, err := r.parseEnvFile(envFile, map[string]string{})
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		if actualMap["CACHED"] != "top-secret" || actualMap["UNCACHED"] != "plain" {
+			t.Errorf("Unexpected values %v", mapToSortedSlice(actualMap))
+		}
+	}
+	if n := count("bash -c echo top-secret"); n != 1 {
+		t.Errorf("Expected the cached command to run once, ran %d times", n)
+	}
+	if n := count("bash -c echo plain"); n != 2 {
+		t.Errorf("Expected the uncached command to run twice, ran %d times", n)
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheDirPath, "*"+cacheFileSuffix))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one cache file, Got %v (%v)", files, err)
+	}
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read cache file: %v", err)
+	}
+	if strings.Contains(string(content), "top-secret") || strings.Contains(string(content), "echo") {
+		t.Errorf("Cache file is not encrypted: %q", content)
+	}
+
+	// Without a cache (--no-cache), the command runs again.
+	r := newResolver(executor)
+	if _, err := r.parseEnvFile(envFile, map[string]string{}); err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	if n := count("bash -c echo top-secret"); n != 2 {
+		t.Errorf("Expected the command to run again without a cache, ran %d times", n)
+	}
+
+	removed, err := newSecretCache(cacheDirPath).clear()
+	if err != nil || removed != 1 {
+		t.Errorf("clear() = %d, %v; expected 1, nil", removed, err)
+	}
+	if _, err := os.Stat(files[0]); !os.IsNotExist(err) {
+		t.Errorf("Expected the cache file to be removed, Got %v", err)
+	}
+}
+
+// TestSecretCacheExpiry checks that expired entries are ignored, and removed
+// when they are read or another entry is cached.
+func TestSecretCacheExpiry(t *testing.T) {
+	setupAgeConfigDir(t)
+	cache := newSecretCache(t.TempDir())
+
+	for _, key := range []string{"cmd:echo soon", "cmd:echo never read"} {
+		if err := cache.put(key, "value", time.Millisecond); err != nil {
+			t.Fatalf("put returned error: %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, _, ok := cache.get("cmd:echo soon"); ok {
+		t.Errorf("Expected the expired entry to be missing")
+	}
+	if _, err := os.Stat(cache.path("cmd:echo soon")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired entry to be removed, Got %v", err)
+	}
+	if err := cache.put("cmd:echo later", "value", time.Hour); err != nil {
+		t.Fatalf("put returned error: %v", err)
+	}
+	if _, err := os.Stat(cache.path("cmd:echo never read")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired entry to be removed by put, Got %v", err)
+	}
+	if value, expires, ok := cache.get("cmd:echo later"); !ok || value != "value" || time.Until(expires) <= 0 {
+		t.Errorf("get() = %q, %v, %t; expected a valid entry", value, expires, ok)
+	}
+}
+
+// TestSecretCacheKeyedByContext checks that a secret cached for one Vault
+// server is not served for another.
+func TestSecretCacheKeyedByContext(t *testing.T) {
+	setupAgeConfigDir(t)
+	cacheDirPath := t.TempDir()
+
+	var requests, otherRequests int32
+	server := newVaultTestServer(t, &requests)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherRequests, 1)
+		fmt.Fprint(w, `{"data":{"data":{"password":"other-secret"},"metadata":{}}}`)
+	}))
+	t.Cleanup(other.Close)
+
+	resolve := func(addr string) string {
+		r := newResolver(defaultCommandExecutor)
+		r.cache = newSecretCache(cacheDirPath)
+		env := map[string]string{"VAULT_ADDR": addr, "VAULT_TOKEN": "test-token"}
+		return r.applySecretReferences("${secret:vault:kv/data/app#password}", "DB_PASS", "test.env", 1, entryOptions{cacheTTL: time.Hour}, env, nil, io.Discard)
+	}
+	for _, tt := range []struct{ addr, expected string }{
+		{server.URL, "s3cret"},
+		{other.URL, "other-secret"},
+		{server.URL, "s3cret"}, // Cached.
+	} {
+		if actual := resolve(tt.addr); actual != tt.expected {
+			t.Errorf("With VAULT_ADDR=%s: expected %q, Got %q", tt.addr, tt.expected, actual)
+		}
+	}
+	if n, m := atomic.LoadInt32(&requests), atomic.LoadInt32(&otherRequests); n != 1 || m != 1 {
+		t.Errorf("Expected 1 request to each server, Got %d and %d", n, m)
+	}
+}
+
+// TestSecretCacheKeyedByRedefinedVariables checks that cached commands are
+// shared by invocations whose environments differ in variables the file does
+// not redefine, such as GPG_TTY, but not in those it does.
+func TestSecretCacheKeyedByRedefinedVariables(t *testing.T) {
+	setupAgeConfigDir(t)
+	cacheDirPath := t.TempDir()
+	envFile := filepath.Join(t.TempDir(), "cached.env")
+	if err := ioutil.WriteFile(envFile, []byte("STAGE=$STAGE-x\n# @cache 1h\nA=$(echo $STAGE)\n# @cache 1h\nB=$[printenv STAGE]\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	executor, count := countingCommandExecutor()
+	resolve := func(inheritedEnvMap map[string]string) map[string]string {
+		r := newResolver(executor)
+		r.cache = newSecretCache(cacheDirPath)
+		actualMap, err := r.parseEnvFile(envFile, inheritedEnvMap)
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		return actualMap
+	}
+	for _, tt := range []struct {
+		gpgTTY, stage, expected string
+	}{
+		{"/dev/pts/1", "dev", "dev-x"},
+		{"/dev/pts/2", "dev", "dev-x"}, // Cached.
+		{"/dev/pts/2", "prod", "prod-x"},
+	} {
+		actualMap := resolve(map[string]string{"GPG_TTY": tt.gpgTTY, "STAGE": tt.stage})
+		if actualMap["A"] != tt.expected || actualMap["B"] != tt.expected {
+			t.Errorf("With STAGE=%s: expected A and B to be %q, Got %q and %q", tt.stage, tt.expected, actualMap["A"], actualMap["B"])
+		}
+	}
+	if n := count("bash -c printenv STAGE"); n != 2 {
+		t.Errorf("Expected 'printenv STAGE' to run once per value of STAGE, ran %d times", n)
+	}
+}
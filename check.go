@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// checkEnvFiles checks the chained .env files at envFilePaths, on top of the
+// variables in osEnvMap, without resolving them. Each problem is reported as a
+// warning on diag. It returns the number of problems and of variables defined.
+func checkEnvFiles(envFilePaths []string, osEnvMap map[string]string, diag io.Writer) (problems int, variables int, err error) {
+	var report bytes.Buffer
+	defined := make(map[string]bool) // Variables visible to the next entry.
+	for key := range osEnvMap {
+		defined[key] = true
+	}
+	keys := make(map[string]bool)
+
+	for _, envFilePath := range envFilePaths {
+		lines, err := readEnvFileLines(envFilePath)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		definedOnLine := make(map[string]int)
+		var directives entryOptions
+		for i, line := range lines {
+			entry, ok := parseEnvLine(line, i+1, envFilePath, &directives, &report)
+			if !ok {
+				continue
+			}
+			if previous, ok := definedOnLine[entry.key]; ok {
+				fmt.Fprintf(&report, " » setnv: Warning: '%s' on line %d in '%s' was already defined on line %d.\n", entry.key, entry.lineNum, envFilePath, previous)
+			}
+			reported := make(map[string]bool)
+			for _, matches := range variableExpansionRegex.FindAllStringSubmatch(entry.value, -1) {
+				name := matches[1] + matches[2] // One of the groups is empty.
+				if !defined[name] && !reported[name] {
+					reported[name] = true
+					fmt.Fprintf(&report, " » setnv: Warning: '%s' on line %d in '%s' references '%s', which is not defined before it.\n", entry.key, entry.lineNum, envFilePath, name)
+				}
+			}
+			for _, matches := range secretRefRegex.FindAllStringSubmatch(entry.value, -1) {
+				if _, ok := secretProviders[matches[1]]; !ok {
+					fmt.Fprintf(&report, " » setnv: Warning: '%s' on line %d in '%s' uses the unknown secret scheme '%s'.\n", entry.key, entry.lineNum, envFilePath, matches[1])
+				}
+			}
+			definedOnLine[entry.key] = entry.lineNum
+			defined[entry.key] = true
+			keys[entry.key] = true
+		}
+	}
+
+	diag.Write(report.Bytes())
+	return bytes.Count(report.Bytes(), []byte("\n")), len(keys), nil
+}
+
+// runCheckCommand implements `setnv check <id>[,<id2>,...]`: it checks the
+// .env files of the IDs without running any command, and fails if there are
+// problems.
+func runCheckCommand(args []string) error {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: setnv check <id>[,<id2>,...]")
+	}
+	envFilePaths, err := findChainedEnvFiles(args[0])
+	if err != nil {
+		return err
+	}
+
+	problems, variables, err := checkEnvFiles(envFilePaths, environMap(), os.Stderr)
+	if err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("found %d problem(s) in %s", problems, strings.Join(envFilePaths, ", "))
+	}
+	fmt.Fprintf(os.Stderr, " » setnv: No problems found in %s (%d variables).\n", strings.Join(envFilePaths, ", "), variables)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.env")
+	dev := filepath.Join(dir, "dev.env")
+	if err := os.WriteFile(base, []byte("HOST=localhost\nURL=http://$HOST:$PORT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dev, []byte(strings.Join([]string{
+		"PORT=8080",
+		"DSN=$HOST:$PORT/${DB}",  // DB is only defined below.
+		"TOKEN=$(gopass show x)", // Not run.
+		"KEY=${secret:nope:x}",
+		"PORT=9090",
+		"no equals sign",
+		"# @retry many",
+		"DB=app",
+		"HOME_DIR=$HOME",
+	}, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var diag bytes.Buffer
+	problems, variables, err := checkEnvFiles([]string{base, dev}, map[string]string{"HOME": "/home/me"}, &diag)
+	if err != nil {
+		t.Fatalf("checkEnvFiles returned error: %v", err)
+	}
+	if problems != 6 || variables != 8 {
+		t.Errorf("Expected 6 problems in 8 variables, Got %d in %d:\n%s", problems, variables, diag.String())
+	}
+	for _, expected := range []string{
+		"'URL' on line 2 in '" + base + "' references 'PORT'",
+		"'DSN' on line 2 in '" + dev + "' references 'DB'",
+		"unknown secret scheme 'nope'",
+		"'PORT' on line 5 in '" + dev + "' was already defined on line 1",
+		"Skipping malformed line 6",
+		"Ignoring directive on line 7",
+	} {
+		if !strings.Contains(diag.String(), expected) {
+			t.Errorf("Expected a warning containing %q, Got:\n%s", expected, diag.String())
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options are the parsed command-line arguments of setnv.
+type options struct {
+	help    bool
+	version bool
+
+	sandboxed bool // Pass only the variables of the .env files to the executable.
+	view      bool // Print the variables and exit.
+	export    bool // Print `export` commands for `eval`.
+
+	jobs         int           // How many substitutions may run at the same time.
+	cmdTimeout   time.Duration // Limits every substitution without `# @timeout`.
+	retries      int           // Retries of a failed substitution or secret lookup without `# @retry`.
+	retryBackoff time.Duration // The wait before the first retry.
+	noCache      bool          // Ignore `# @cache` directives.
+
+	reveal      bool // With view, print sensitive values instead of masking them.
+	fingerprint bool // With view, add a fingerprint to masked values.
+	provenance  bool // With view, show where each variable is defined.
+
+	asFiles   string // Comma-separated variables to deliver as files.
+	supervise bool   // Run the executable as a subprocess.
+	watch     bool   // Restart the executable when the .env files change.
+	procfile  string // Run the processes of this Procfile instead of an executable.
+	keepGoing bool   // With procfile, keep the others running when one exits.
+
+	trace bool // Log how the .env files of the IDs are found.
+
+	envOverrides stringList // `-e KEY=VALUE`, resolved after all files.
+	envFiles     stringList // `--env-file <path>`, resolved after the IDs' files.
+
+	// subcommand is the environment subcommand (run, shell, export, or view)
+	// the options were given to; empty for the positional syntax.
+	subcommand string
+	ids        string   // The comma-separated IDs; empty if none were given.
+	command    []string // The executable and its arguments; empty for a subshell.
+}
+
+// subcommand is a `setnv <name> ...` command.
+type subcommand struct {
+	usage string // Printed by `setnv <name> --help`.
+	// run implements the subcommand with its arguments. It is nil for the
+	// environment subcommands, which parseArgs turns into options.
+	run func(args []string) error
+}
+
+// envOptionsUsage lists the options of the environment subcommands.
+const envOptionsUsage = `Options:
+  --sandboxed, -e KEY=VALUE, --env-file <path>, --jobs <n>, --cmd-timeout <d>,
+  --retry <n>, --retry-backoff <d>, --no-cache, --trace (see 'setnv --help')
+`
+
+// subcommands are the subcommands of setnv. A first argument naming one is
+// never taken for an ID; `setnv -- <id>` and `setnv run <id>` still load the
+// environment <id> (see warnShadowedEnvFile).
+var subcommands = map[string]subcommand{
+	"run": {usage: `Usage: setnv run [options] <id>[,<id2>,...] [--] <executable> [<args...>]
+
+Runs <executable> with the variables of the .env files, like
+'setnv <id>[,<id2>,...] <executable> [<args...>]'. With --procfile <path>, runs
+the processes of a Procfile instead.
+
+` + envOptionsUsage + `  --as-files <keys>, --supervise, --watch, --procfile <path>, --keep-going
+
+Example: setnv run common,dev -- go run main.go
+`},
+	"shell": {usage: `Usage: setnv shell [options] <id>[,<id2>,...]
+
+Launches an interactive $SHELL (default: bash) with the variables of the .env
+files, like 'setnv <id>[,<id2>,...]'.
+
+` + envOptionsUsage + `  --as-files <keys>, --supervise
+
+Example: setnv shell base,project_secrets
+`},
+	"export": {usage: `Usage: eval "$(setnv export [options] <id>[,<id2>,...])"
+
+Prints 'export' commands for the variables of the .env files, to be evaluated
+in the current shell, like 'setnv <id>[,<id2>,...] --export'.
+
+` + envOptionsUsage + `
+Example: eval "$(setnv export common,prod)"
+`},
+	"view": {usage: `Usage: setnv view [options] <id>[,<id2>,...]
+
+Prints the resolved variables of the .env files, like
+'setnv <id>[,<id2>,...] --view'. Sensitive values are masked.
+
+` + envOptionsUsage + `  --fingerprint  Append a short hash to masked values.
+  --reveal       Print sensitive values in plaintext.
+  --provenance   Append the file and line defining each variable, and the
+                 definitions it overrides.
+
+Example: setnv view dev --fingerprint
+`},
+	"list": {usage: `Usage: setnv list [--long]
+
+Lists the IDs of the .env files in the current directory and in the
+configuration directory, including its subdirectories (e.g. 'team/dev' for
+team/dev.env), with the file each refers to. Files shadowed by another with
+the same ID, which is used instead, are marked.
+
+  -l, --long  Also show the number of keys, whether any value uses command
+              substitution, and the first line of the comment at the top.
+              Encrypted files are decrypted to read them; nothing is resolved.
+`, run: runListCommand},
+	"explain": {usage: `Usage: setnv explain <id>[,<id2>,...] [<KEY>...]
+
+Explains where each KEY, or every variable of the .env files, comes from: the
+file and line that set it last, its raw value before expansion and
+substitution, the variables, secrets, and commands it depends on, and the
+earlier definitions and inherited value it overrides. Nothing is resolved, so
+no command is run. Exits with status 1 if a KEY is not defined anywhere.
+
+Example: setnv explain base,team,dev DATABASE_URL
+`, run: runExplainCommand},
+	"diff": {usage: `Usage: setnv diff [options] <id>[,<id2>,...] <id>[,<id2>,...]
+       setnv diff [options] <id>[,<id2>,...] --against-env
+
+Resolves both environments and prints the variables added (+), removed (-),
+and changed (~) from the first to the second. With --against-env, compares the
+current environment with the variables the .env files would set. Sensitive
+values are masked and shown with their fingerprint.
+
+Options:
+  --against-env  Compare with the current environment.
+  --reveal       Print sensitive values in plaintext.
+  --jobs <n>, --cmd-timeout <d>, --retry <n>, --retry-backoff <d>, --no-cache
+                 (see 'setnv --help')
+
+Example: setnv diff common,staging common,prod
+`, run: runDiffCommand},
+	"which": {usage: `Usage: setnv which <id>[,<id2>,...]
+
+Prints the .env file used for each ID, as an absolute path, followed by every
+path considered for it in order, and whether it was used, not found, or
+shadowed by the one used. Exits with status 1 if a file is not found.
+
+Example: setnv which dev,secrets
+`, run: runWhichCommand},
+	"check": {usage: `Usage: setnv check <id>[,<id2>,...]
+
+Checks the .env files for problems without running any command or looking up
+any secret: malformed lines, invalid directives, unknown secret schemes,
+references to undefined variables, and keys defined twice in a file. Exits
+with status 1 if there are any.
+
+Example: setnv check common,prod
+`, run: runCheckCommand},
+	"edit": {usage: `Usage: setnv edit <id> [-r <recipient>]...
+
+Opens the .env file of <id> in $EDITOR. An age-encrypted <id>.env.age is
+decrypted to a private temporary file and encrypted again afterwards, to the
+recipients in ~/.config/setnv/recipients, each -r <recipient>, and the local
+identity.
+`, run: runEditCommand},
+	"encrypt": {usage: `Usage: setnv encrypt <id> [-r <recipient>]...
+
+Encrypts <id>.env to <id>.env.age, to the recipients in
+~/.config/setnv/recipients, each -r <recipient>, and the local identity.
+`, run: runEncryptCommand},
+	"cache": {usage: `Usage: setnv cache clear
+
+Removes every result cached by '# @cache <ttl>' directives.
+`, run: runCacheCommand},
+}
+
+// warnShadowedEnvFile warns if there is a .env file for the ID name, which
+// `setnv <name>` no longer loads because name is a subcommand.
+func warnShadowedEnvFile(name string) {
+	if envFilePath, err := findEnvFile(name); err == nil {
+		fmt.Fprintf(os.Stderr, " » setnv: Warning: '%s' is a subcommand and does not load '%s'; use 'setnv -- %s' or 'setnv run %s -- <executable>' for that.\n", name, envFilePath, name, name)
+	}
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newFlagSet returns the flags of setnv, stored into opts. Both `-name` and
+// `--name`, and both `--name value` and `--name=value`, are accepted.
+func newFlagSet(opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("setnv", flag.ContinueOnError)
+	fs.SetOutput(io.Discard) // Errors are reported by main.
+	fs.Usage = func() {}
+
+	fs.BoolVar(&opts.help, "help", false, "")
+	fs.BoolVar(&opts.help, "h", false, "")
+	fs.BoolVar(&opts.version, "version", false, "")
+	fs.BoolVar(&opts.sandboxed, "sandboxed", false, "")
+	fs.BoolVar(&opts.view, "view", false, "")
+	fs.BoolVar(&opts.export, "export", false, "")
+
+	opts.jobs = 1
+	fs.Func("jobs", "", func(value string) error {
+		jobs, err := strconv.Atoi(value)
+		if err != nil || jobs < 1 {
+			return fmt.Errorf("requires a positive number")
+		}
+		opts.jobs = jobs
+		return nil
+	})
+	fs.Func("cmd-timeout", "", durationFlag(&opts.cmdTimeout, "10s"))
+	fs.Func("retry", "", func(value string) error {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return fmt.Errorf("requires a number of retries")
+		}
+		opts.retries = retries
+		return nil
+	})
+	opts.retryBackoff = defaultRetryBackoff
+	fs.Func("retry-backoff", "", durationFlag(&opts.retryBackoff, "500ms"))
+	fs.BoolVar(&opts.noCache, "no-cache", false, "")
+
+	fs.BoolVar(&opts.reveal, "reveal", false, "")
+	fs.BoolVar(&opts.fingerprint, "fingerprint", false, "")
+	fs.BoolVar(&opts.provenance, "provenance", false, "")
+
+	fs.StringVar(&opts.asFiles, "as-files", "", "")
+	fs.BoolVar(&opts.supervise, "supervise", false, "")
+	fs.BoolVar(&opts.watch, "watch", false, "")
+	fs.StringVar(&opts.procfile, "procfile", "", "")
+	fs.BoolVar(&opts.keepGoing, "keep-going", false, "")
+
+	fs.BoolVar(&opts.trace, "trace", false, "")
+	fs.Var(&opts.envOverrides, "e", "")
+	fs.Var(&opts.envFiles, "env-file", "")
+	return fs
+}
+
+// durationFlag parses a non-negative duration into d.
+func durationFlag(d *time.Duration, example string) func(string) error {
+	return func(value string) error {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("requires a duration such as '%s'", example)
+		}
+		*d = duration
+		return nil
+	}
+}
+
+// parseArgs parses the command-line arguments (without the program name).
+// Options may be given before the IDs and between the IDs and the command,
+// which starts at the first argument after the IDs, or after `--`:
+//
+//	setnv --sandboxed --view dev
+//	setnv common,dev --jobs 4 go run .
+//	setnv common,dev -- go run main.go
+//
+// Everything from the command on belongs to the command.
+//
+// The environment subcommands (`setnv run dev -- go run .`) take the same
+// options and set the mode instead of --view or --export. A leading `--`
+// makes the next argument an ID even if it names a subcommand:
+//
+//	setnv -- list go run .
+func parseArgs(args []string) (*options, error) {
+	opts := &options{}
+	fs := newFlagSet(opts)
+	if len(args) > 1 && args[0] == "--" {
+		opts.ids, args = args[1], args[2:]
+	} else if len(args) > 0 && subcommands[args[0]].usage != "" && subcommands[args[0]].run == nil {
+		opts.subcommand, args = args[0], args[1:]
+	}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		// The flag package consumes a `--` that ends the options.
+		separated := len(rest) < len(args) && args[len(args)-len(rest)-1] == "--"
+		if separated || opts.ids != "" {
+			opts.command = rest
+			break
+		}
+		if len(rest) == 0 {
+			break
+		}
+		opts.ids, args = rest[0], rest[1:]
+	}
+	if opts.subcommand != "" && (opts.view || opts.export) {
+		return nil, fmt.Errorf("'setnv %s' cannot be combined with --view or --export", opts.subcommand)
+	}
+	switch opts.subcommand {
+	case "view":
+		opts.view = true
+	case "export":
+		opts.export = true
+	}
+	return opts, opts.validate()
+}
+
+// validate checks the combinations of options.
+func (opts *options) validate() error {
+	if opts.help || opts.version || opts.ids == "" {
+		return nil // Handled by main.
+	}
+	for _, override := range opts.envOverrides {
+		if key, _, ok := strings.Cut(override, "="); !ok || strings.TrimSpace(key) == "" || strings.HasPrefix(strings.TrimSpace(key), "#") {
+			return fmt.Errorf("-e expects KEY=VALUE")
+		}
+	}
+	switch {
+	case opts.subcommand == "run" && len(opts.command) == 0 && opts.procfile == "":
+		return fmt.Errorf("'setnv run' requires an executable, e.g. 'setnv run %s -- go run .'; use 'setnv shell %s' for a subshell", opts.ids, opts.ids)
+	case opts.subcommand == "shell" && (len(opts.command) > 0 || opts.procfile != "" || opts.watch):
+		return fmt.Errorf("'setnv shell' launches a subshell; use 'setnv run' to run an executable")
+	case opts.view && opts.export:
+		return fmt.Errorf("--view and --export cannot be combined")
+	case (opts.view || opts.export) && len(opts.command) > 0:
+		return fmt.Errorf("--view and --export do not run an executable, got '%s'", opts.command[0])
+	case opts.procfile != "" && (opts.view || opts.export || opts.watch || len(opts.command) > 0):
+		return fmt.Errorf("--procfile runs the processes of the Procfile; it cannot be combined with an executable, --view, --export, or --watch")
+	case opts.watch && len(opts.command) == 0:
+		return fmt.Errorf("--watch requires an executable to run, e.g. 'setnv dev --watch go run .'")
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestParseArgs checks that options are taken from anywhere before the
+// command, which starts after the IDs or after `--`.
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args            []string
+		expectedIDs     string
+		expectedCommand []string
+		check           func(*options) bool
+	}{
+		{[]string{"--sandboxed", "--view", "dev"}, "dev", nil, func(o *options) bool { return o.sandboxed && o.view }},
+		{[]string{"dev", "--export", "--sandboxed"}, "dev", nil, func(o *options) bool { return o.export && o.sandboxed }},
+		{[]string{"--jobs", "4", "common,dev", "--cmd-timeout=10s", "go", "run", "."}, "common,dev", []string{"go", "run", "."},
+			func(o *options) bool { return o.jobs == 4 && o.cmdTimeout == 10*time.Second }},
+		{[]string{"common,dev", "--", "go", "run", "main.go"}, "common,dev", []string{"go", "run", "main.go"}, nil},
+		{[]string{"dev", "--", "--odd-executable"}, "dev", []string{"--odd-executable"}, nil},
+		{[]string{"dev", "make", "--jobs", "4"}, "dev", []string{"make", "--jobs", "4"}, func(o *options) bool { return o.jobs == 1 }},
+		{[]string{"-e", "A=1", "dev", "--env-file", "x.env", "-e", "B=2", "env"}, "dev", []string{"env"},
+			func(o *options) bool {
+				return reflect.DeepEqual(o.envOverrides, stringList{"A=1", "B=2"}) && reflect.DeepEqual(o.envFiles, stringList{"x.env"})
+			}},
+		{[]string{"dev", "--"}, "dev", nil, nil},
+		{[]string{"--version"}, "", nil, func(o *options) bool { return o.version }},
+		{[]string{"run", "common,dev", "--", "go", "run", "main.go"}, "common,dev", []string{"go", "run", "main.go"},
+			func(o *options) bool { return o.subcommand == "run" }},
+		{[]string{"view", "--reveal", "dev"}, "dev", nil, func(o *options) bool { return o.view && o.reveal }},
+		{[]string{"export", "dev"}, "dev", nil, func(o *options) bool { return o.export }},
+		{[]string{"shell", "--sandboxed", "dev"}, "dev", nil, func(o *options) bool { return o.sandboxed }},
+		{[]string{"run", "run", "env"}, "run", []string{"env"}, nil},
+		{[]string{"--", "list"}, "list", nil, nil},
+		{[]string{"--", "view", "--sandboxed", "env"}, "view", []string{"env"}, func(o *options) bool { return o.subcommand == "" && !o.view && o.sandboxed }},
+	}
+	for _, tt := range tests {
+		opts, err := parseArgs(tt.args)
+		if err != nil {
+			t.Errorf("parseArgs(%q) returned error: %v", tt.args, err)
+			continue
+		}
+		if opts.ids != tt.expectedIDs || len(opts.command)+len(tt.expectedCommand) > 0 && !reflect.DeepEqual(opts.command, tt.expectedCommand) {
+			t.Errorf("parseArgs(%q) = %q, %q; expected %q, %q", tt.args, opts.ids, opts.command, tt.expectedIDs, tt.expectedCommand)
+		}
+		if tt.check != nil && !tt.check(opts) {
+			t.Errorf("parseArgs(%q): unexpected options %+v", tt.args, opts)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--no-such-flag", "dev"},
+		{"dev", "--jobs"},
+		{"dev", "--jobs", "0"},
+		{"dev", "--cmd-timeout", "soon"},
+		{"dev", "--export", "env"},
+		{"dev", "--view", "--export"},
+		{"dev", "--watch"},
+		{"dev", "--procfile", "Procfile", "env"},
+		{"dev", "-e", "NOVALUE"},
+		{"run", "dev"},
+		{"shell", "dev", "ls"},
+		{"view", "dev", "--export"},
+		{"export", "dev", "env"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("parseArgs(%q): expected an error", args)
+		}
+	}
+}
+
+// TestWarnShadowedEnvFile checks that a .env file named like a subcommand is
+// reported, with the ways to load it.
+func TestWarnShadowedEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SETNV_CONFIG_DIR", dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "list.env"), []byte("A=1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write list.env: %v", err)
+	}
+
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	warnShadowedEnvFile("list")
+	warnShadowedEnvFile("check") // No check.env.
+	w.Close()
+	capturedStderr, _ := ioutil.ReadAll(r)
+	os.Stderr = oldStderr
+
+	expected := " » setnv: Warning: 'list' is a subcommand and does not load '" + filepath.Join(dir, "list.env") + "'; use 'setnv -- list' or 'setnv run list -- <executable>' for that.\n"
+	if string(capturedStderr) != expected {
+		t.Errorf("Expected %q, Got %q", expected, capturedStderr)
+	}
+}
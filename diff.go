@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// envDifference is a variable that differs between two environments.
+type envDifference struct {
+	key           string
+	before, after string
+	added         bool // Only in after.
+	removed       bool // Only in before.
+}
+
+// diffEnvs returns the variables that were added, removed, or changed from
+// before to after, sorted by key.
+func diffEnvs(before, after map[string]string) []envDifference {
+	var differences []envDifference
+	for key, value := range after {
+		if old, ok := before[key]; !ok {
+			differences = append(differences, envDifference{key: key, after: value, added: true})
+		} else if old != value {
+			differences = append(differences, envDifference{key: key, before: old, after: value})
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			differences = append(differences, envDifference{key: key, before: value, removed: true})
+		}
+	}
+	sort.Slice(differences, func(i, j int) bool { return differences[i].key < differences[j].key })
+	return differences
+}
+
+// writeEnvDifferences writes differences to w, one per line: `+ KEY="new"`,
+// `- KEY="old"`, or `~ KEY="old" -> "new"`. Unless reveal is set, the values
+// of the variables sensitive reports are masked, with their fingerprint.
+func writeEnvDifferences(w io.Writer, differences []envDifference, sensitive func(key string) bool, reveal bool) {
+	show := func(key, value string) string {
+		if !reveal && sensitive(key) {
+			value = maskValue(value, true)
+		}
+		return fmt.Sprintf("%q", value)
+	}
+	for _, d := range differences {
+		switch {
+		case d.added:
+			fmt.Fprintf(w, "+ %s=%s\n", d.key, show(d.key, d.after))
+		case d.removed:
+			fmt.Fprintf(w, "- %s=%s\n", d.key, show(d.key, d.before))
+		default:
+			fmt.Fprintf(w, "~ %s=%s -> %s\n", d.key, show(d.key, d.before), show(d.key, d.after))
+		}
+	}
+}
+
+// diffOptions are the options of setnv that `setnv diff` accepts.
+var diffOptions = map[string]bool{
+	"against-env": true, "reveal": true, "no-cache": true,
+	"jobs": true, "cmd-timeout": true, "retry": true, "retry-backoff": true,
+}
+
+// runDiffCommand implements `setnv diff <ids> <ids>` and `setnv diff <ids>
+// --against-env`: it resolves the environments and prints the variables that
+// differ from the first to the second, or from the current environment to the
+// resolved one.
+func runDiffCommand(args []string) error {
+	opts := &options{}
+	fs := newFlagSet(opts)
+	againstEnv := fs.Bool("against-env", false, "")
+	var chains []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		chains, args = append(chains, fs.Arg(0)), fs.Args()[1:]
+	}
+	var unsupported error
+	fs.Visit(func(f *flag.Flag) {
+		if !diffOptions[f.Name] && unsupported == nil {
+			dashes := "--"
+			if len(f.Name) == 1 {
+				dashes = "-"
+			}
+			unsupported = fmt.Errorf("'setnv diff' does not accept %s%s", dashes, f.Name)
+		}
+	})
+	if unsupported != nil {
+		return unsupported
+	}
+	if *againstEnv && len(chains) != 1 || !*againstEnv && len(chains) != 2 {
+		return fmt.Errorf("usage: setnv diff <ids> <ids>, or setnv diff <ids> --against-env")
+	}
+
+	// Ctrl-C (or SIGTERM) while resolving stops every running substitution.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	osEnvMap := environMap()
+	var resolvers []*resolver
+	var envMaps []map[string]string
+	for _, chain := range chains {
+		envFilePaths, err := findChainedEnvFiles(chain)
+		if err != nil {
+			return err
+		}
+		r := newEnvResolver(ctx, opts)
+		envMap, err := resolveEnvFiles(r, envFilePaths, nil, osEnvMap)
+		if err != nil {
+			return fmt.Errorf("could not resolve '%s': %w", chain, err)
+		}
+		resolvers, envMaps = append(resolvers, r), append(envMaps, envMap)
+	}
+
+	from, to := "the current environment", "'"+chains[0]+"'"
+	if *againstEnv {
+		// Only the variables the files define are compared; the rest of the
+		// environment is left as it is.
+		current := make(map[string]string)
+		for key := range envMaps[0] {
+			if value, ok := osEnvMap[key]; ok {
+				current[key] = value
+			}
+		}
+		envMaps = append([]map[string]string{current}, envMaps...)
+	} else {
+		from, to = to, "'"+chains[1]+"'"
+	}
+
+	differences := diffEnvs(envMaps[0], envMaps[1])
+	writeEnvDifferences(os.Stdout, differences, func(key string) bool {
+		for _, r := range resolvers {
+			if r.isSensitive(key) {
+				return true
+			}
+		}
+		return false
+	}, opts.reveal)
+
+	var added, removed int
+	for _, d := range differences {
+		if d.added {
+			added++
+		} else if d.removed {
+			removed++
+		}
+	}
+	fmt.Fprintf(os.Stderr, " » setnv: From %s to %s: %d added, %d removed, %d changed.\n", from, to, added, removed, len(differences)-added-removed)
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDiffEnvs(t *testing.T) {
+	useFingerprintKeyDir(t)
+	before := map[string]string{"API_URL": "https://staging", "DB_PASS": "s3cret", "DEBUG": "1", "PORT": "80"}
+	after := map[string]string{"API_URL": "https://prod", "DB_PASS": "pr0d", "PORT": "80", "REPLICAS": "3"}
+
+	differences := diffEnvs(before, after)
+	expected := []envDifference{
+		{key: "API_URL", before: "https://staging", after: "https://prod"},
+		{key: "DB_PASS", before: "s3cret", after: "pr0d"},
+		{key: "DEBUG", before: "1", removed: true},
+		{key: "REPLICAS", after: "3", added: true},
+	}
+	if !reflect.DeepEqual(differences, expected) {
+		t.Fatalf("Expected %+v, Got %+v", expected, differences)
+	}
+
+	sensitive := func(key string) bool { return key == "DB_PASS" }
+	var out bytes.Buffer
+	writeEnvDifferences(&out, differences, sensitive, false)
+	expectedOutput := `~ API_URL="https://staging" -> "https://prod"
+~ DB_PASS="**** ` + fingerprint("s3cret") + `" -> "**** ` + fingerprint("pr0d") + `"
+- DEBUG="1"
++ REPLICAS="3"
+`
+	if out.String() != expectedOutput {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expectedOutput, out.String())
+	}
+
+	out.Reset()
+	writeEnvDifferences(&out, differences[1:2], sensitive, true)
+	if expected := "~ DB_PASS=\"s3cret\" -> \"pr0d\"\n"; out.String() != expected {
+		t.Errorf("Expected %q with --reveal, Got %q", expected, out.String())
+	}
+
+	if differences := diffEnvs(after, after); len(differences) != 0 {
+		t.Errorf("Expected no differences, Got %+v", differences)
+	}
+}
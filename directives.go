@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// entryOptions are the settings of a single entry, given by directive comments
+// (`# @<directive> ...`) on the lines above it:
+//
+//	# @timeout 5s
+//	# @retry 3 backoff=500ms
+//	# @cache 8h
+//	DB_PASS=$(gopass show prod/db)
+//
+// Directives apply to the next `KEY=VALUE` entry only.
+type entryOptions struct {
+	timeout    time.Duration // `@timeout <duration>`; zero disables the timeout.
+	hasTimeout bool          // Whether `@timeout` was given, overriding --cmd-timeout.
+
+	retries  int           // `@retry <n>`: how often a failed command is run again.
+	backoff  time.Duration // `@retry <n> backoff=<duration>`: the delay before the first retry.
+	hasRetry bool          // Whether `@retry` was given, overriding --retry.
+
+	cacheTTL time.Duration // `@cache <ttl>`: how long the result is cached on disk; zero disables caching.
+
+	asFile bool // Set by the `@file:` value prefix instead: deliver the value as a file (see writeSecretFiles).
+}
+
+// parseDirective applies the directive in comment, a comment line without its
+// leading '#', to opts. It reports false if the comment is not a directive.
+func parseDirective(comment string, opts *entryOptions) (bool, error) {
+	comment = strings.TrimSpace(comment)
+	if !strings.HasPrefix(comment, "@") {
+		return false, nil
+	}
+	fields := strings.Fields(comment[1:])
+	if len(fields) == 0 {
+		return true, fmt.Errorf("empty directive")
+	}
+
+	switch name, args := fields[0], fields[1:]; name {
+	case "timeout":
+		if len(args) != 1 {
+			return true, fmt.Errorf("@timeout requires a duration, e.g. '# @timeout 5s'")
+		}
+		timeout, err := time.ParseDuration(args[0])
+		if err != nil || timeout < 0 {
+			return true, fmt.Errorf("invalid @timeout duration '%s'", args[0])
+		}
+		opts.timeout, opts.hasTimeout = timeout, true
+	case "retry":
+		if len(args) == 0 {
+			return true, fmt.Errorf("@retry requires a number of retries, e.g. '# @retry 3 backoff=500ms'")
+		}
+		retries, err := strconv.Atoi(args[0])
+		if err != nil || retries < 0 {
+			return true, fmt.Errorf("invalid @retry count '%s'", args[0])
+		}
+		backoff := defaultRetryBackoff
+		for _, arg := range args[1:] {
+			value, ok := strings.CutPrefix(arg, "backoff=")
+			if !ok {
+				return true, fmt.Errorf("unknown @retry option '%s'", arg)
+			}
+			if backoff, err = time.ParseDuration(value); err != nil || backoff < 0 {
+				return true, fmt.Errorf("invalid @retry backoff '%s'", value)
+			}
+		}
+		opts.retries, opts.backoff, opts.hasRetry = retries, backoff, true
+	case "cache":
+		if len(args) != 1 {
+			return true, fmt.Errorf("@cache requires a time to live, e.g. '# @cache 8h'")
+		}
+		ttl, err := time.ParseDuration(args[0])
+		if err != nil || ttl <= 0 {
+			return true, fmt.Errorf("invalid @cache time to live '%s'", args[0])
+		}
+		opts.cacheTTL = ttl
+	case "pre-exec", "post-exec":
+		// File-level hooks, collected by execHooksIn; only checked here.
+		if _, err := parseHookCommand(strings.TrimPrefix(comment, "@"+name)); err != nil {
+			return true, err
+		}
+	default:
+		return true, fmt.Errorf("unknown directive '@%s'", name)
+	}
+	return true, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseDirective checks the parsing of directive comments.
+func TestParseDirective(t *testing.T) {
+	tests := []struct {
+		comment         string
+		expectDirective bool
+		expected        entryOptions
+		expectedError   string
+	}{
+		{" plain comment", false, entryOptions{}, ""},
+		{" @timeout 5s", true, entryOptions{timeout: 5 * time.Second, hasTimeout: true}, ""},
+		{"@timeout 0", true, entryOptions{hasTimeout: true}, ""},
+		{" @timeout", true, entryOptions{}, "requires a duration"},
+		{" @timeout soon", true, entryOptions{}, "invalid @timeout duration"},
+		{" @retry 3", true, entryOptions{retries: 3, backoff: defaultRetryBackoff, hasRetry: true}, ""},
+		{" @retry 2 backoff=1s", true, entryOptions{retries: 2, backoff: time.Second, hasRetry: true}, ""},
+		{" @retry many", true, entryOptions{}, "invalid @retry count"},
+		{" @retry 2 jitter=1s", true, entryOptions{}, "unknown @retry option"},
+		{" @cache 8h", true, entryOptions{cacheTTL: 8 * time.Hour}, ""},
+		{" @cache 0", true, entryOptions{}, "invalid @cache time to live"},
+		{" @pre-exec $[./scripts/check-vpn.sh]", true, entryOptions{}, ""},
+		{" @post-exec notify-send", true, entryOptions{}, "hooks require a command"},
+		{" @frobnicate", true, entryOptions{}, "unknown directive '@frobnicate'"},
+	}
+
+	for _, tt := range tests {
+		var opts entryOptions
+		isDirective, err := parseDirective(tt.comment, &opts)
+		if isDirective != tt.expectDirective {
+			t.Errorf("parseDirective(%q) directive = %t, expected %t", tt.comment, isDirective, tt.expectDirective)
+		}
+		if tt.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+				t.Errorf("parseDirective(%q) error = %v, expected %q", tt.comment, err, tt.expectedError)
+			}
+			continue
+		}
+		if err != nil || opts != tt.expected {
+			t.Errorf("parseDirective(%q) = %+v, %v; expected %+v", tt.comment, opts, err, tt.expected)
+		}
+	}
+}
+
+// TestParseEnvFileTimeouts checks that `# @timeout` and the resolver's default
+// timeout kill hung commands, and that a directive only applies to the next entry.
+func TestParseEnvFileTimeouts(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "timeouts.env")
+	envContent := `# @timeout 100ms
+SLOW=$(sleep 5; echo late)
+# @timeout 0
+UNLIMITED=$(sleep 0.5; echo done)
+DEFAULT=$[sleep 6; echo late]
+# @retries 3
+FAST=$(echo fast)`
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	defer func() { os.Stderr = oldStderr }()
+
+	envResolver := newResolver(defaultCommandExecutor)
+	envResolver.cmdTimeout = 300 * time.Millisecond
+	start := time.Now()
+	actualMap, err := envResolver.parseEnvFile(envFile, map[string]string{})
+	elapsed := time.Since(start)
+
+	w.Close()
+	capturedStderr, _ := ioutil.ReadAll(r)
+	os.Stderr = oldStderr
+
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{"SLOW": "", "UNLIMITED": "done", "DEFAULT": "", "FAST": "fast"}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+	if elapsed > 2*time.Second {
+		t.Errorf("Expected hung commands to be killed, took %s", elapsed)
+	}
+	for _, expected := range []string{"timed out after 100ms", "timed out after 300ms", "unknown directive '@retries'"} {
+		if !strings.Contains(string(capturedStderr), expected) {
+			t.Errorf("Expected stderr to contain %q, Got:\n%s", expected, capturedStderr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// secretFilePrefix marks a value to be delivered as a file:
+	// `KEY=@file:$(gopass show x)`.
+	secretFilePrefix = "@file:"
+
+	// secretFileEnvSuffix is appended to the name of a variable delivered as a
+	// file to name the variable holding its path, following the common `*_FILE`
+	// convention (e.g., POSTGRES_PASSWORD_FILE).
+	secretFileEnvSuffix = "_FILE"
+)
+
+// secretFilesBaseDir returns where secret files are created: preferably on a
+// tmpfs that only the user can read, so that secrets never reach a disk.
+func secretFilesBaseDir() string {
+	for _, dir := range []string{os.Getenv("XDG_RUNTIME_DIR"), "/dev/shm"} {
+		if info, err := os.Stat(dir); dir != "" && err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return os.TempDir()
+}
+
+// writeSecretFiles writes the value of every variable in keys to its own file,
+// readable only by the user, in a new private directory. In envMap, each such
+// KEY is replaced by KEY_FILE=<path>, so the value is neither visible in
+// /proc/<pid>/environ nor inherited by the child's own children. It returns the
+// directory, which the caller removes once the child has exited.
+func writeSecretFiles(envMap map[string]string, keys []string) (string, error) {
+	dir, err := os.MkdirTemp(secretFilesBaseDir(), "setnv-")
+	if err != nil {
+		return "", fmt.Errorf("could not create a directory for secret files: %w", err)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := filepath.Join(dir, key)
+		if err := os.WriteFile(path, []byte(envMap[key]), 0600); err != nil {
+			os.RemoveAll(dir)
+			return "", fmt.Errorf("could not write the secret file for '%s': %w", key, err)
+		}
+		delete(envMap, key)
+		envMap[key+secretFileEnvSuffix] = path
+	}
+	return dir, nil
+}
+
+// secretFileKeys returns the variables of envMap to deliver as files, sorted:
+// those defined with the `@file:` prefix, and those in the comma-separated
+// asFiles list of --as-files. Listed variables that envMap does not define are
+// returned as undefined.
+func secretFileKeys(r *resolver, envMap map[string]string, asFiles string) (keys []string, undefined []string) {
+	keySet := make(map[string]bool)
+	for _, key := range r.fileVars() {
+		keySet[key] = true
+	}
+	if asFiles != "" {
+		for _, key := range strings.Split(asFiles, ",") {
+			key = strings.TrimSpace(key)
+			if _, ok := envMap[key]; !ok {
+				undefined = append(undefined, key)
+				continue
+			}
+			keySet[key] = true
+		}
+	}
+	for key := range keySet {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, undefined
+}
+
+// fileVars returns the resolved variables whose latest definition has the
+// `@file:` prefix.
+func (r *resolver) fileVars() []string {
+	var keys []string
+	for key, asFile := range r.asFile {
+		if asFile {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
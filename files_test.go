@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestFileVars checks that `@file:` is stripped from values and that only the
+// latest definition of a variable decides whether it is delivered as a file.
+func TestFileVars(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "files.env")
+	envContent := `DB_PASS=@file:$(echo hunter2)
+TLS_KEY='@file:literal key'
+PLAIN=value
+DB_PASS=@file:$DB_PASS-2
+TLS_KEY=no-longer-a-file
+`
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	for _, jobs := range []int{1, 4} {
+		r := newResolver(defaultCommandExecutor)
+		r.setJobs(jobs)
+		actualMap, err := r.parseEnvFile(envFile, map[string]string{})
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		expectedMap := map[string]string{"DB_PASS": "hunter2-2", "TLS_KEY": "no-longer-a-file", "PLAIN": "value"}
+		if !reflect.DeepEqual(actualMap, expectedMap) {
+			t.Errorf("jobs=%d: Expected %v, Got %v", jobs, mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+		}
+		if keys := r.fileVars(); !reflect.DeepEqual(keys, []string{"DB_PASS"}) {
+			t.Errorf("jobs=%d: fileVars() = %v, expected [DB_PASS]", jobs, keys)
+		}
+	}
+}
+
+// TestWriteSecretFiles checks that secret files are private and replace their
+// variables in the environment with `*_FILE` paths.
+func TestWriteSecretFiles(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	envMap := map[string]string{"DB_PASS": "hunter2", "TOKEN": "tok", "PLAIN": "value"}
+
+	dir, err := writeSecretFiles(envMap, []string{"TOKEN", "DB_PASS"})
+	if err != nil {
+		t.Fatalf("writeSecretFiles returned error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Expected a private directory, Got %v (%v)", info.Mode(), err)
+	}
+	expectedMap := map[string]string{
+		"DB_PASS_FILE": filepath.Join(dir, "DB_PASS"),
+		"TOKEN_FILE":   filepath.Join(dir, "TOKEN"),
+		"PLAIN":        "value",
+	}
+	if !reflect.DeepEqual(envMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(envMap))
+	}
+	for key, value := range map[string]string{"DB_PASS": "hunter2", "TOKEN": "tok"} {
+		path := envMap[key+secretFileEnvSuffix]
+		content, err := ioutil.ReadFile(path)
+		if err != nil || string(content) != value {
+			t.Errorf("Secret file for %s contains %q (%v), expected %q", key, content, err, value)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("Expected secret file for %s to have mode 0600, Got %v (%v)", key, info.Mode(), err)
+		}
+	}
+}
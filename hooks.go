@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// execHook is a command declared in a .env file to run around the executable:
+//
+//	# @pre-exec $[./scripts/check-vpn.sh]
+//	# @post-exec $[notify-send "server stopped"]
+//
+// Pre-exec hooks run, in the order of the chained files, before the executable
+// is started; if one fails, it is not started. Post-exec hooks run after it
+// exits, with its exit status in SETNV_EXIT_STATUS. Both run with `bash -c` and
+// the executable's environment, with their output on stderr.
+type execHook struct {
+	command     string
+	lineNum     int
+	envFilePath string
+}
+
+// execHookDirectives are the directives declaring exec hooks. Unlike the other
+// directives, they belong to the file rather than to the next entry.
+var execHookDirectives = map[string]bool{"pre-exec": true, "post-exec": true}
+
+// parseHookCommand returns the command of a hook directive, given as `$[...]`
+// or `$(...)`. Variables in the command are expanded by the shell.
+func parseHookCommand(arg string) (string, error) {
+	arg = strings.TrimSpace(arg)
+	for _, re := range []*regexp.Regexp{alternateCommandRegex, genericCommandRegex} {
+		if matches := re.FindStringSubmatch(arg); matches != nil && matches[0] == arg {
+			return matches[1], nil
+		}
+	}
+	return "", fmt.Errorf("hooks require a command, e.g. '# @pre-exec $[./scripts/check-vpn.sh]'")
+}
+
+// execHooksIn returns the pre- and post-exec hooks declared in the lines of a
+// .env file. Malformed hooks are skipped; parseEnvLine warns about them.
+func execHooksIn(lines []string, envFilePath string) (pre, post []execHook) {
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line[1:])
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "@") || !execHookDirectives[fields[0][1:]] {
+			continue
+		}
+		command, err := parseHookCommand(strings.TrimPrefix(strings.TrimSpace(line[1:]), fields[0]))
+		if err != nil {
+			continue
+		}
+		hook := execHook{command: command, lineNum: i + 1, envFilePath: envFilePath}
+		if fields[0] == "@pre-exec" {
+			pre = append(pre, hook)
+		} else {
+			post = append(post, hook)
+		}
+	}
+	return pre, post
+}
+
+// runExecHook runs hook with env as its environment. It is killed when ctx is
+// done, e.g. on Ctrl-C, or after the --cmd-timeout.
+func (r *resolver) runExecHook(ctx context.Context, hook execHook, env map[string]string) error {
+	cmd := r.cmdExecutor(defaultShell, "-c", hook.command)
+	cmd.Env = mapToSlice(env)
+	cmd.Stdout = os.Stderr // Keep stdout for the executable.
+	cmd.Stderr = os.Stderr
+
+	ctx, cancel := withTimeout(ctx, r.cmdTimeout)
+	defer cancel()
+	err := runProcess(ctx, cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok && ctx.Err() == nil {
+		return fmt.Errorf("hook '%s' on line %d in '%s' failed with exit code %d", hook.command, hook.lineNum, hook.envFilePath, exitErr.ExitCode())
+	} else if err != nil {
+		return fmt.Errorf("hook '%s' on line %d in '%s' failed: %v", hook.command, hook.lineNum, hook.envFilePath, err)
+	}
+	return nil
+}
+
+// runPreExecHooks runs the pre-exec hooks in order, and stops at the first
+// that fails. Ctrl-C stops the running hook.
+func (r *resolver) runPreExecHooks(hooks []execHook, env map[string]string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for _, hook := range hooks {
+		if err := r.runExecHook(ctx, hook, env); err != nil {
+			return fmt.Errorf("pre-exec %v", err)
+		}
+	}
+	return nil
+}
+
+// runPostExecHooks runs the post-exec hooks after the executable exited with
+// status, warning about those that fail.
+func (r *resolver) runPostExecHooks(hooks []execHook, env map[string]string, status int) {
+	env = mergeMaps(env, map[string]string{"SETNV_EXIT_STATUS": strconv.Itoa(status)})
+	for _, hook := range hooks {
+		if err := r.runExecHook(context.Background(), hook, env); err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Warning: post-exec %v.\n", err)
+		}
+	}
+}
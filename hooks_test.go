@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestExecHooksIn checks which hook directives are collected from a file.
+func TestExecHooksIn(t *testing.T) {
+	lines := []string{
+		"# @pre-exec $[./scripts/check-vpn.sh --quiet]",
+		"A=1",
+		"  #   @post-exec $(notify-send done)",
+		"# @pre-exec not-a-command",
+		"# @timeout 5s",
+		"# @pre-exec $[echo second]",
+		"B=2 # @pre-exec $[echo not-a-comment-line]",
+	}
+	pre, post := execHooksIn(lines, "dev.env")
+
+	expectedPre := []execHook{
+		{command: "./scripts/check-vpn.sh --quiet", lineNum: 1, envFilePath: "dev.env"},
+		{command: "echo second", lineNum: 6, envFilePath: "dev.env"},
+	}
+	expectedPost := []execHook{{command: "notify-send done", lineNum: 3, envFilePath: "dev.env"}}
+	if !reflect.DeepEqual(pre, expectedPre) {
+		t.Errorf("Expected pre-exec hooks %v, Got %v", expectedPre, pre)
+	}
+	if !reflect.DeepEqual(post, expectedPost) {
+		t.Errorf("Expected post-exec hooks %v, Got %v", expectedPost, post)
+	}
+}
+
+// TestRunExecHooks checks that hooks run through the resolver's command
+// executor with the given environment, that a failing pre-exec hook stops the
+// following ones, and that post-exec hooks see the exit status.
+func TestRunExecHooks(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "hooks.log")
+	executor, count := countingCommandExecutor()
+	r := newResolver(executor)
+	env := map[string]string{"OUT": out, "NAME": "api"}
+
+	pre := []execHook{
+		{command: `echo "pre $NAME" >> "$OUT"`, lineNum: 1, envFilePath: "dev.env"},
+		{command: "exit 4", lineNum: 2, envFilePath: "dev.env"},
+		{command: `echo "not reached" >> "$OUT"`, lineNum: 3, envFilePath: "dev.env"},
+	}
+	err := r.runPreExecHooks(pre, env)
+	if err == nil || !strings.Contains(err.Error(), "pre-exec hook 'exit 4' on line 2 in 'dev.env' failed with exit code 4") {
+		t.Errorf("Expected the second hook to fail, Got %v", err)
+	}
+	if n := count(`bash -c echo "not reached" >> "$OUT"`); n != 0 {
+		t.Errorf("Expected hooks after a failure not to run, ran %d times", n)
+	}
+
+	post := []execHook{
+		{command: "exit 1", lineNum: 4, envFilePath: "dev.env"}, // Only warned about.
+		{command: `echo "post $NAME $SETNV_EXIT_STATUS" >> "$OUT"`, lineNum: 5, envFilePath: "dev.env"},
+	}
+	r.runPostExecHooks(post, env, 3)
+
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Failed to read hook output: %v", err)
+	}
+	if expected := "pre api\npost api 3\n"; string(content) != expected {
+		t.Errorf("Expected hook output %q, Got %q", expected, content)
+	}
+}
+
+// TestParseEnvFileCollectsExecHooks checks that chained files add their hooks
+// in order.
+func TestParseEnvFileCollectsExecHooks(t *testing.T) {
+	dir := t.TempDir()
+	firstFile := filepath.Join(dir, "base.env")
+	secondFile := filepath.Join(dir, "dev.env")
+	if err := ioutil.WriteFile(firstFile, []byte("# @pre-exec $[echo base]\nA=1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	if err := ioutil.WriteFile(secondFile, []byte("# @pre-exec $[echo dev]\n# @post-exec $[echo bye]\nB=2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	r := newResolver(defaultCommandExecutor)
+	if _, err := resolveEnvFiles(r, []string{firstFile, secondFile}, nil, map[string]string{}); err != nil {
+		t.Fatalf("resolveEnvFiles returned error: %v", err)
+	}
+	var preCommands []string
+	for _, hook := range r.preExecHooks {
+		preCommands = append(preCommands, hook.command)
+	}
+	if !reflect.DeepEqual(preCommands, []string{"echo base", "echo dev"}) {
+		t.Errorf("Expected pre-exec hooks [echo base, echo dev], Got %v", preCommands)
+	}
+	if len(r.postExecHooks) != 1 || r.postExecHooks[0].command != "echo bye" {
+		t.Errorf("Expected one post-exec hook, Got %v", r.postExecHooks)
+	}
+}
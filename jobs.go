@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"sync"
+)
+
+// resolveEntriesConcurrently resolves the entries of a .env file with up to
+// r.jobs substitutions running at the same time.
+//
+// An entry waits only for the entries it references with `$VAR` and for the
+// earlier entries without substitutions (see entryDependencies). Only those are
+// visible to its commands and secret providers, so the result does not depend
+// on timing: commands are memoized by the variables they see (see envKey), so
+// entries running the same command line with different variables do not share
+// a result, values are assigned in file order, as in a sequential run, and
+// each line's diagnostics are buffered and written to stderr in file order,
+// redacted with every value resolved in the file.
+func (r *resolver) resolveEntriesConcurrently(lines []string, envFilePath string, inheritedEnvMap map[string]string) map[string]string {
+	diags := make([]bytes.Buffer, len(lines))
+	var entries []envEntry
+	var directives entryOptions
+	for i, line := range lines {
+		if entry, ok := parseEnvLine(line, i+1, envFilePath, &directives, &diags[i]); ok {
+			entries = append(entries, entry)
+		}
+	}
+
+	for _, entry := range entries {
+		r.markSensitive(entry) // In file order, before any entry is resolved.
+		r.asFile[entry.key] = entry.opts.asFile
+	}
+
+	visible := entryDependencies(entries)
+	values := make([]string, len(entries))
+	done := make([]chan struct{}, len(entries))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+
+	var wg sync.WaitGroup
+	for i := range entries {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+
+			currentEnvMap := make(map[string]string, len(visible[i]))
+			for key, j := range visible[i] {
+				<-done[j]
+				currentEnvMap[key] = values[j]
+			}
+			if r.ctx.Err() != nil {
+				return // Interrupted; the caller reports it once.
+			}
+			entry := entries[i]
+			values[i] = r.resolveEntry(entry, envFilePath, inheritedEnvMap, currentEnvMap, &diags[entry.lineNum-1])
+		}(i)
+	}
+	wg.Wait()
+
+	diag := r.redactor.writer(os.Stderr) // Redacts values resolved after the warning, too.
+	for i := range diags {
+		diag.Write(diags[i].Bytes())
+	}
+	diag.Flush()
+
+	resolvedEnvMap := make(map[string]string)
+	for i, entry := range entries {
+		resolvedEnvMap[entry.key] = values[i] // Later definitions override earlier ones.
+	}
+	return resolvedEnvMap
+}
+
+// entryDependencies returns, for every entry, the earlier entries it may see,
+// as a map from variable name to entry index. An entry sees the latest earlier
+// definition of every variable it references, and of every variable whose
+// value is static: neither substituted nor derived from a substitution. Static
+// values (e.g., VAULT_ADDR or PASSWORD_STORE_DIR) are thus still passed to
+// commands, while unrelated substitutions can run at the same time. A secret
+// reference also references its provider's context variables, so that a
+// lookup sees a VAULT_TOKEN set with `$(...)` on an earlier line.
+func entryDependencies(entries []envEntry) []map[string]int {
+	visible := make([]map[string]int, len(entries))
+	dynamic := make([]bool, len(entries))
+	latest := make(map[string]int) // Index of the latest definition of each variable so far.
+
+	for i, entry := range entries {
+		refs := referencedVars(entry.value)
+		for name := range providerContextVars(entry.value) {
+			refs[name] = true
+		}
+		dynamic[i] = hasSubstitution(entry.value)
+
+		visible[i] = make(map[string]int)
+		for key, j := range latest {
+			if refs[key] || !dynamic[j] {
+				visible[i][key] = j
+			}
+			if refs[key] && dynamic[j] {
+				dynamic[i] = true
+			}
+		}
+		latest[entry.key] = i
+	}
+	return visible
+}
+
+// referencedVars returns the names of the variables referenced in value.
+func referencedVars(value string) map[string]bool {
+	refs := make(map[string]bool)
+	for _, matches := range variableExpansionRegex.FindAllStringSubmatch(value, -1) {
+		if matches[1] != "" {
+			refs[matches[1]] = true
+		} else {
+			refs[matches[2]] = true
+		}
+	}
+	return refs
+}
+
+// providerContextVars returns the context variables (see contextSecretProvider)
+// of the providers of the secret references in value, including gopass for
+// `$(gopass show ...)`.
+func providerContextVars(value string) map[string]bool {
+	schemes := make(map[string]bool)
+	for _, matches := range secretRefRegex.FindAllStringSubmatch(value, -1) {
+		schemes[matches[1]] = true
+	}
+	if gopassRegex.MatchString(value) {
+		schemes["gopass"] = true
+	}
+	vars := make(map[string]bool)
+	for scheme := range schemes {
+		if p, ok := secretProviders[scheme].(contextSecretProvider); ok {
+			for _, name := range p.ContextVars() {
+				vars[name] = true
+			}
+		}
+	}
+	return vars
+}
+
+// hasSubstitution reports whether value contains a command substitution or a
+// secret reference.
+func hasSubstitution(value string) bool {
+	return secretRefRegex.MatchString(value) ||
+		gopassRegex.MatchString(value) ||
+		alternateCommandRegex.MatchString(value) ||
+		genericCommandRegex.MatchString(value)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestEntryDependencies checks which earlier entries each entry waits for.
+func TestEntryDependencies(t *testing.T) {
+	entries := []envEntry{
+		{key: "ADDR", value: "http://vault", lineNum: 1},      // static
+		{key: "TOKEN", value: "$(get-token)", lineNum: 2},     // substituted
+		{key: "URL", value: "$ADDR/v1", lineNum: 3},           // static, from a static value
+		{key: "AUTH", value: "Bearer $TOKEN", lineNum: 4},     // derived from a substitution
+		{key: "USER", value: "$(whoami)", lineNum: 5},         // independent substitution
+		{key: "HEADER", value: "$[sign $AUTH]", lineNum: 6},   // substitution referencing a dynamic value
+		{key: "ADDR", value: "$(discover-vault)", lineNum: 7}, // redefinition hides the static ADDR
+		{key: "FINAL", value: "$[check $URL]", lineNum: 8},    // sees URL, but no longer ADDR
+	}
+
+	expected := []map[string]int{
+		{},
+		{"ADDR": 0},
+		{"ADDR": 0},
+		{"ADDR": 0, "TOKEN": 1, "URL": 2},
+		{"ADDR": 0, "URL": 2},
+		{"ADDR": 0, "URL": 2, "AUTH": 3},
+		{"ADDR": 0, "URL": 2},
+		{"URL": 2},
+	}
+
+	actual := entryDependencies(entries)
+	for i := range entries {
+		if !reflect.DeepEqual(actual[i], expected[i]) {
+			t.Errorf("Entry %s (line %d): expected %v, Got %v", entries[i].key, entries[i].lineNum, expected[i], actual[i])
+		}
+	}
+}
+
+// TestParseEnvFileConcurrently checks that independent substitutions run at the
+// same time, that dependent ones still see their inputs, and that values and
+// diagnostics come out as they would sequentially.
+func TestParseEnvFileConcurrently(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "jobs.env")
+	envContent := `BASE=base
+SLOW_A=$(sleep 0.3; echo a)
+SLOW_B=$(sleep 0.3; echo b)
+SLOW_C=$[sleep 0.3; echo c]
+FAILS_LATE=$(sleep 0.2; exit 4)
+FAILS_EARLY=$(exit 5)
+JOINED=$(echo $SLOW_A-$SLOW_B-$BASE)
+SEES_STATIC=$(echo "[$BASE]")
+WAITS=$(echo "[$SLOW_C]")
+this line is malformed`
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	defer func() { os.Stderr = oldStderr }()
+
+	envResolver := newResolver(defaultCommandExecutor)
+	envResolver.setJobs(4)
+	start := time.Now()
+	actualMap, err := envResolver.parseEnvFile(envFile, map[string]string{})
+	elapsed := time.Since(start)
+
+	w.Close()
+	capturedStderr, _ := ioutil.ReadAll(r)
+	os.Stderr = oldStderr
+
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{
+		"BASE":        "base",
+		"SLOW_A":      "a",
+		"SLOW_B":      "b",
+		"SLOW_C":      "c",
+		"FAILS_LATE":  "",
+		"FAILS_EARLY": "",
+		"JOINED":      "a-b-base",
+		"SEES_STATIC": "[base]",
+		"WAITS":       "[c]",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+	if elapsed > 800*time.Millisecond {
+		t.Errorf("Expected independent substitutions to run concurrently, took %s", elapsed)
+	}
+
+	stderr := string(capturedStderr)
+	late := strings.Index(stderr, "exit code 4")
+	early := strings.Index(stderr, "exit code 5")
+	malformed := strings.Index(stderr, "Skipping malformed line 10")
+	if late < 0 || early < 0 || malformed < 0 || !(late < early && early < malformed) {
+		t.Errorf("Expected diagnostics in file order, Got:\n%s", stderr)
+	}
+}
+
+// TestParseEnvFileJobsMatchSequential checks that --jobs does not change the
+// result when the same command line runs with different variables.
+func TestParseEnvFileJobsMatchSequential(t *testing.T) {
+	var requests int32
+	server := newVaultTestServer(t, &requests)
+	envFile := filepath.Join(t.TempDir(), "jobs.env")
+	envContent := fmt.Sprintf(`X=1
+A=$[printenv X]
+X=2
+B=$[printenv X]
+C=$[printenv X]-$(echo shared)
+X=3
+D=$[printenv X]-$(echo shared)
+VAULT_ADDR=%s
+VAULT_TOKEN=$(echo test-token)
+PASS=${secret:vault:kv/data/app#password}`, server.URL)
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	resolve := func(jobs int) map[string]string {
+		envResolver := newResolver(defaultCommandExecutor)
+		envResolver.setJobs(jobs)
+		actualMap, err := envResolver.parseEnvFile(envFile, map[string]string{})
+		if err != nil {
+			t.Fatalf("parseEnvFile with %d jobs returned error: %v", jobs, err)
+		}
+		return actualMap
+	}
+	expectedMap := map[string]string{"X": "3", "A": "1", "B": "2", "C": "2-shared", "D": "3-shared",
+		"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token", "PASS": "s3cret"}
+	if sequential := resolve(1); !reflect.DeepEqual(sequential, expectedMap) {
+		t.Fatalf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(sequential))
+	}
+	for i := 0; i < 10; i++ { // Which entry runs first varies.
+		if concurrent := resolve(4); !reflect.DeepEqual(concurrent, expectedMap) {
+			t.Fatalf("Expected --jobs 4 to match --jobs 1 (%v), Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(concurrent))
+		}
+	}
+}
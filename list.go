@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// listedEnvFile is a .env file found by `setnv list`.
+type listedEnvFile struct {
+	id   string // e.g. "dev", or "team/dev" in a subdirectory.
+	path string
+	// shadowedBy is the file that findEnvFile uses for id instead, if any.
+	shadowedBy string
+}
+
+// envIDFromFileName returns the ID of a .env file name, and false if name is
+// not one (see envFileNames).
+func envIDFromFileName(name string) (string, bool) {
+	for _, suffix := range []string{".env" + ageFileSuffix, ".env"} {
+		if id, ok := strings.CutSuffix(name, suffix); ok && id != "" && !strings.HasSuffix(id, "/") {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// envFilesIn returns the .env files in dir, and with recursive, in its
+// subdirectories, except hidden ones and node_modules. A missing dir has none.
+func envFilesIn(dir string, recursive bool) ([]listedEnvFile, error) {
+	var files []listedEnvFile
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			if entry != nil && entry.IsDir() && path != dir {
+				return fs.SkipDir // Unreadable subdirectories are not searched.
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && (!recursive || strings.HasPrefix(entry.Name(), ".") || entry.Name() == "node_modules") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if id, ok := envIDFromFileName(filepath.ToSlash(rel)); ok {
+			files = append(files, listedEnvFile{id: id, path: path})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list '%s': %w", dir, err)
+	}
+	// Within a directory, `<id>.env` wins over `<id>.env.age`, which it
+	// precedes in the lexical order of the walk.
+	sort.SliceStable(files, func(i, j int) bool { return files[i].id < files[j].id })
+	return files, nil
+}
+
+// findEnvFiles returns the .env files of the IDs found in the current
+// directory, and in the configuration directory dir and its subdirectories,
+// sorted by ID. For each ID, the files are those traceEnvFile considers, in its
+// order: the one findEnvFile uses comes first, and shadows the others. A file
+// in a subdirectory of the current directory, such as `team/dev.env`, is thus
+// listed if dir has an ID `team/dev`, which it shadows.
+func findEnvFiles(dir string) ([]listedEnvFile, error) {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, search := range []struct {
+		dir       string
+		recursive bool
+	}{{".", false}, {dir, true}} {
+		found, err := envFilesIn(search.dir, search.recursive)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range found {
+			if !seen[file.id] {
+				seen[file.id] = true
+				ids = append(ids, file.id)
+			}
+		}
+	}
+	sort.Strings(ids)
+
+	var files []listedEnvFile
+	for _, id := range ids {
+		var winner string
+		_, err := traceEnvFile(id, func(path, decision string) {
+			if decision == "not found" {
+				return
+			}
+			file := listedEnvFile{id: id, path: path}
+			if winner == "" {
+				winner = path
+			} else {
+				file.shadowedBy = winner
+			}
+			files = append(files, file)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// envFileDetails are what `setnv list --long` shows about a .env file.
+type envFileDetails struct {
+	description string // The first line of the comment block at the top.
+	keys        int
+	commands    bool // Whether any value uses command substitution.
+}
+
+// readEnvFileDetails reads the details of the .env file at envFilePath,
+// decrypting it if needed. Nothing is resolved.
+func readEnvFileDetails(envFilePath string) (envFileDetails, error) {
+	var details envFileDetails
+	file, err := openEnvFile(envFilePath)
+	if err != nil {
+		return details, err
+	}
+	defer file.Close()
+
+	keys := make(map[string]bool)
+	header := true // Still before the first entry.
+	var directives entryOptions
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if comment, ok := strings.CutPrefix(line, "#"); ok && header && details.description == "" {
+			if comment = strings.TrimSpace(comment); !strings.HasPrefix(comment, "@") {
+				details.description = comment
+			}
+		}
+		entry, ok := parseEnvLine(line, lineNum, envFilePath, &directives, io.Discard)
+		if !ok {
+			continue
+		}
+		header = false
+		keys[entry.key] = true
+		for _, re := range []*regexp.Regexp{alternateCommandRegex, genericCommandRegex} {
+			details.commands = details.commands || re.MatchString(entry.value)
+		}
+	}
+	details.keys = len(keys)
+	return details, scanner.Err()
+}
+
+// runListCommand implements `setnv list [--long]`: it prints every ID found
+// by findEnvFiles with the file it refers to, and marks the files that are
+// shadowed by another with the same ID.
+func runListCommand(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	long := flags.Bool("long", false, "")
+	flags.BoolVar(long, "l", false, "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return fmt.Errorf("usage: setnv list [--long]")
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+
+	files, err := findEnvFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, " » setnv: No .env files found in the current directory or '%s'.\n", dir)
+		return nil
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *long {
+		fmt.Fprintln(out, "ID\tFILE\tKEYS\tCOMMANDS\tDESCRIPTION")
+	}
+	for _, file := range files {
+		id, note := file.id, ""
+		if file.shadowedBy != "" {
+			id, note = "", "(shadowed by "+file.shadowedBy+")"
+		}
+		if !*long {
+			fmt.Fprintln(out, strings.TrimRight(id+"\t"+file.path+"\t"+note, "\t"))
+			continue
+		}
+		keys, commands, description := "?", "?", note
+		if details, err := readEnvFileDetails(file.path); err != nil {
+			description = strings.TrimSpace("(could not read: " + err.Error() + ") " + note)
+		} else {
+			keys, commands = strconv.Itoa(details.keys), "no"
+			if details.commands {
+				commands = "yes"
+			}
+			description = strings.TrimSpace(details.description + " " + note)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\n", id, file.path, keys, commands, description)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestFindEnvFiles checks that IDs are found in the current directory and in
+// the subdirectories of the configuration directory, in the order findEnvFile
+// prefers them, including a file in a subdirectory of the current directory.
+func TestFindEnvFiles(t *testing.T) {
+	cwd, configDir := t.TempDir(), t.TempDir()
+	for path, content := range map[string]string{
+		filepath.Join(cwd, "dev.env"):                  "A=1\n",
+		filepath.Join(cwd, "sub", "ignored.env"):       "A=1\n", // Only the configuration directory is searched recursively.
+		filepath.Join(configDir, "dev.env"):            "A=1\n",
+		filepath.Join(configDir, "prod.env.age"):       "",
+		filepath.Join(configDir, "prod.env"):           "A=1\n",
+		filepath.Join(configDir, "team", "qa.env"):     "A=1\n",
+		filepath.Join(cwd, "team", "qa.env"):           "A=1\n",
+		filepath.Join(configDir, ".git", "hidden.env"): "A=1\n",
+		filepath.Join(configDir, "notes.txt"):          "",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(cwd); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+	t.Setenv("SETNV_CONFIG_DIR", configDir)
+
+	files, err := findEnvFiles(configDir)
+	if err != nil {
+		t.Fatalf("findEnvFiles returned error: %v", err)
+	}
+	expected := []listedEnvFile{
+		{id: "dev", path: "dev.env"},
+		{id: "dev", path: filepath.Join(configDir, "dev.env"), shadowedBy: "dev.env"},
+		{id: "prod", path: filepath.Join(configDir, "prod.env")},
+		{id: "prod", path: filepath.Join(configDir, "prod.env.age"), shadowedBy: filepath.Join(configDir, "prod.env")},
+		{id: "team/qa", path: filepath.Join("team", "qa.env")},
+		{id: "team/qa", path: filepath.Join(configDir, "team", "qa.env"), shadowedBy: filepath.Join("team", "qa.env")},
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected %+v, Got %+v", expected, files)
+	}
+}
+
+func TestReadEnvFileDetails(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "dev.env")
+	content := "# @cache 1h\n# Local development\n# against the staging database\n\nHOST=localhost\n# Not the description\nTOKEN=$[gopass show dev/token]\nHOST=127.0.0.1\n"
+	if err := os.WriteFile(envFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	details, err := readEnvFileDetails(envFile)
+	expected := envFileDetails{description: "Local development", keys: 2, commands: true}
+	if err != nil || details != expected {
+		t.Errorf("readEnvFileDetails() = %+v, %v; expected %+v", details, err, expected)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+)
+
+// substitutionMemo remembers the outcome of command substitutions and secret
+// lookups for the duration of one setnv invocation, so that a command or secret
+// referenced by several variables (or by several chained files) is only run or
+// fetched once. This avoids repeated pinentry/GPG prompts and slow round trips.
+// Failures are remembered as well: a command that failed once is not retried.
+//
+// Commands are keyed by the variables the files redefine as well (see envKey),
+// so the same command line run after a variable changed is run again.
+//
+// It is safe for concurrent use; concurrent callers of the same key wait for
+// the first one and share its result.
+type substitutionMemo struct {
+	mu      sync.Mutex
+	results map[string]*memoResult
+}
+
+// memoResult is the single evaluation of one memoized key.
+type memoResult struct {
+	once   sync.Once
+	output string
+	err    error
+}
+
+func newSubstitutionMemo() *substitutionMemo {
+	return &substitutionMemo{results: make(map[string]*memoResult)}
+}
+
+// entry returns the memoResult for key, creating it if needed.
+func (m *substitutionMemo) entry(key string) *memoResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result, ok := m.results[key]
+	if !ok {
+		result = &memoResult{}
+		m.results[key] = result
+	}
+	return result
+}
+
+// do returns the remembered result for key, calling fn to compute it the
+// first time key is seen.
+func (m *substitutionMemo) do(key string, fn func() (string, error)) (string, error) {
+	result := m.entry(key)
+	result.once.Do(func() {
+		result.output, result.err = fn()
+	})
+	return result.output, result.err
+}
+
+// volatileEnvVars are variables the shell changes between invocations that do
+// not affect what a command outputs. envKey leaves them out, so that they do
+// not invalidate the secret cache.
+var volatileEnvVars = map[string]bool{"_": true, "SHLVL": true, "OLDPWD": true, "PWD": true}
+
+// markRedefinitions records the variables that lines define again with a new
+// value: variables already set in inheritedEnvMap or by earlier lines, unless
+// set to the same static value. It is called for a whole file before any of
+// its entries is resolved, so that every entry is keyed alike whether or not
+// entries are resolved concurrently (see envKey).
+func (r *resolver) markRedefinitions(lines []string, envFilePath string, inheritedEnvMap map[string]string) {
+	var directives entryOptions
+	for i, line := range lines {
+		entry, ok := parseEnvLine(line, i+1, envFilePath, &directives, io.Discard)
+		if !ok {
+			continue
+		}
+		inherited, isInherited := inheritedEnvMap[entry.key]
+		unchanged := isInherited && !r.defined[entry.key] && entry.value == inherited && !strings.Contains(entry.value, "$")
+		if (isInherited || r.defined[entry.key]) && !unchanged {
+			r.redefined[entry.key] = true
+		}
+		r.defined[entry.key] = true
+	}
+}
+
+// envKey returns a hash of the variables in env that may change what a
+// command run with env outputs within one invocation, and across invocations
+// with the same files: the variables that the files redefine (see
+// markRedefinitions), except volatileEnvVars and the variables derived from
+// substitutions (see markSensitive). Those follow from the commands and
+// variables that produced them, and leaving them out lets `A=$(gopass show x)`
+// and `B=$(gopass show x)` share a single run. Variables that are only added,
+// and the rest of the environment (e.g., GPG_TTY, which differs per terminal),
+// do not change the key.
+func (r *resolver) envKey(env map[string]string) string {
+	hash := sha256.New()
+	for _, pair := range mapToSlice(env) {
+		name, _, _ := strings.Cut(pair, "=")
+		if !r.redefined[name] || volatileEnvVars[name] || r.sensitive[name] {
+			continue
+		}
+		hash.Write([]byte(pair))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
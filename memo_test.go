@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingCommandExecutor returns a commandExecutor that runs commands for real
+// and records how often each command line was executed.
+func countingCommandExecutor() (commandExecutor, func(string) int) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	executor := func(name string, arg ...string) *exec.Cmd {
+		mu.Lock()
+		calls[name+" "+strings.Join(arg, " ")]++
+		mu.Unlock()
+		return exec.Command(name, arg...)
+	}
+	count := func(cmdLine string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[cmdLine]
+	}
+	return executor, count
+}
+
+// TestCommandSubstitutionMemoized checks that a command referenced by several
+// variables, and by a chained file, is only run once per resolver.
+func TestCommandSubstitutionMemoized(t *testing.T) {
+	dir := t.TempDir()
+	firstFile := filepath.Join(dir, "first.env")
+	secondFile := filepath.Join(dir, "second.env")
+	firstContent := "A=$(echo shared)\nB=$[echo shared]\nC=prefix-$(echo shared)\nD=$(echo other)\n"
+	secondContent := "E=$(echo shared)\n"
+	if err := ioutil.WriteFile(firstFile, []byte(firstContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	if err := ioutil.WriteFile(secondFile, []byte(secondContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	executor, count := countingCommandExecutor()
+	r := newResolver(executor)
+
+	firstMap, err := r.parseEnvFile(firstFile, map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	secondMap, err := r.parseEnvFile(secondFile, firstMap)
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+
+	expectedFirst := map[string]string{"A": "shared", "B": "shared", "C": "prefix-shared", "D": "other"}
+	if !reflect.DeepEqual(firstMap, expectedFirst) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedFirst), mapToSortedSlice(firstMap))
+	}
+	if secondMap["E"] != "shared" {
+		t.Errorf("Expected E=shared, Got %q", secondMap["E"])
+	}
+	if n := count("bash -c echo shared"); n != 1 {
+		t.Errorf("Expected 'echo shared' to run once, ran %d times", n)
+	}
+	if n := count("bash -c echo other"); n != 1 {
+		t.Errorf("Expected 'echo other' to run once, ran %d times", n)
+	}
+}
+
+// TestCommandSubstitutionMemoizedPerEnvironment checks that the same command
+// line is run again when a variable it may read has changed, but not when a
+// variable was only added, or an inherited one set to the same value.
+func TestCommandSubstitutionMemoizedPerEnvironment(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env.env")
+	if err := ioutil.WriteFile(envFile, []byte("X=1\nA=$[printenv X]\nX=2\nB=$[printenv X]\nPORT=8080\nLANG=C\nC=$[printenv X]\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	executor, count := countingCommandExecutor()
+	actualMap, err := parseEnvFile(envFile, executor, map[string]string{"LANG": "C"})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{"X": "2", "A": "1", "B": "2", "PORT": "8080", "LANG": "C", "C": "2"}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+	if n := count("bash -c printenv X"); n != 2 {
+		t.Errorf("Expected 'printenv X' to run once per value of X, ran %d times", n)
+	}
+}
+
+// TestCommandSubstitutionFailureMemoized checks that a failing command is not
+// retried, and still produces a warning and an empty value for every variable.
+func TestCommandSubstitutionFailureMemoized(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "failing.env")
+	if err := ioutil.WriteFile(envFile, []byte("A=$(exit 3)\nB=$(exit 3)\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	executor, count := countingCommandExecutor()
+	actualMap, err := parseEnvFile(envFile, executor, map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{"A": "", "B": ""}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+	if n := count("bash -c exit 3"); n != 1 {
+		t.Errorf("Expected the failing command to run once, ran %d times", n)
+	}
+}
+
+// fakeBatchProvider is a batchSecretProvider recording how it was called.
+type fakeBatchProvider struct {
+	mu       sync.Mutex
+	batches  [][]secretRef
+	resolved []secretRef
+}
+
+func (p *fakeBatchProvider) Resolve(_ context.Context, ref secretRef, _ commandExecutor, _ map[string]string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.resolved = append(p.resolved, ref)
+	return "single-" + ref.path, nil
+}
+
+func (p *fakeBatchProvider) ResolveBatch(_ context.Context, refs []secretRef, _ commandExecutor, _ map[string]string) map[secretRef]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.batches = append(p.batches, refs)
+	values := make(map[secretRef]string)
+	for _, ref := range refs {
+		if ref.path != "skip" { // Leave one reference to be resolved individually.
+			values[ref] = "batch-" + ref.path
+		}
+	}
+	return values
+}
+
+// TestSecretReferencesBatched checks that all static references of a batching
+// provider are resolved in a single batch, and that only the references the
+// batch could not resolve (or that depend on variables) are resolved one by one.
+func TestSecretReferencesBatched(t *testing.T) {
+	provider := &fakeBatchProvider{}
+	registerSecretProvider("fakebatch", provider)
+	defer delete(secretProviders, "fakebatch")
+
+	envFile := filepath.Join(t.TempDir(), "batch.env")
+	envContent := `NAME=dyn
+A=${secret:fakebatch:one}
+B=${secret:fakebatch:two}
+C=${secret:fakebatch:one}-${secret:fakebatch:skip}
+D=${secret:fakebatch:$NAME}`
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	actualMap, err := parseEnvFile(envFile, defaultCommandExecutor, map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{
+		"NAME": "dyn",
+		"A":    "batch-one",
+		"B":    "batch-two",
+		"C":    "batch-one-single-skip",
+		"D":    "single-dyn",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+
+	expectedBatches := [][]secretRef{{
+		{scheme: "fakebatch", path: "one"},
+		{scheme: "fakebatch", path: "two"},
+		{scheme: "fakebatch", path: "skip"},
+	}}
+	if !reflect.DeepEqual(provider.batches, expectedBatches) {
+		t.Errorf("Expected batches %v, Got %v", expectedBatches, provider.batches)
+	}
+	expectedResolved := []secretRef{{scheme: "fakebatch", path: "skip"}, {scheme: "fakebatch", path: "dyn"}}
+	if !reflect.DeepEqual(provider.resolved, expectedResolved) {
+		t.Errorf("Expected individual lookups %v, Got %v", expectedResolved, provider.resolved)
+	}
+}
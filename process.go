@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// processKillGrace is how long a cancelled or timed out command is given to
+// exit after SIGTERM before its process group is sent SIGKILL.
+const processKillGrace = 2 * time.Second
+
+// timeoutError is a substitution that did not finish within its timeout. It
+// matches context.DeadlineExceeded, so retries report the attempt as a
+// timeout (see attemptOutcome).
+type timeoutError struct {
+	msg string
+}
+
+func (e timeoutError) Error() string {
+	return e.msg
+}
+
+func (e timeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// runProcess runs cmd in a process group of its own and waits for it to exit.
+//
+// When ctx is done, because a timeout expired or setnv was interrupted, the
+// whole group, including any children the command started, is sent SIGTERM
+// and, if it is still running after processKillGrace, SIGKILL. The returned
+// error is then ctx.Err().
+//
+// If setnv runs in the foreground of a terminal, the group is made the
+// foreground group while the command runs (see takeTerminal), so that it can
+// prompt on /dev/tty (e.g., gpg's pinentry or an MFA code) instead of being
+// stopped by SIGTTIN. Ctrl-C then reaches the command rather than setnv, so a
+// command killed by SIGINT interrupts setnv as well, as a shell does. With
+// --jobs, only one command at a time gets the terminal.
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	// Do not wait forever for output from processes that escaped the group.
+	cmd.WaitDelay = processKillGrace
+	tty := takeTerminal()
+	if tty != nil {
+		defer releaseTerminal(tty)
+		cmd.SysProcAttr.Foreground = true
+		cmd.SysProcAttr.Ctty = int(tty.Fd())
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if tty != nil && cmd.ProcessState != nil && interruptedBy(cmd.ProcessState, syscall.SIGINT) {
+			syscall.Kill(os.Getpid(), syscall.SIGINT) // The Ctrl-C was meant for setnv, too.
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	pgid := cmd.Process.Pid // With Setpgid, the group ID is the leader's PID.
+	_ = syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(processKillGrace):
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		<-done
+	}
+	return ctx.Err()
+}
+
+// interruptedBy reports whether the process that state describes was killed
+// by sig.
+func interruptedBy(state *os.ProcessState, sig syscall.Signal) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == sig
+}
+
+// withTimeout returns ctx limited to timeout, or ctx itself if timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
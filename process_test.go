@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunProcessKillsProcessGroup checks that a timed out command is killed
+// together with the children it started.
+func TestRunProcessKillsProcessGroup(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	cmd := exec.Command("bash", "-c", `sleep 30 & echo $! > "$1"; wait`, "bash", pidFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := runProcess(ctx, cmd); err != context.DeadlineExceeded {
+		t.Fatalf("Expected context.DeadlineExceeded, Got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > processKillGrace {
+		t.Errorf("Command was not stopped in time, took %s", elapsed)
+	}
+
+	content, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("Failed to read child PID: %v", err)
+	}
+	childPID, _ := strconv.Atoi(strings.TrimSpace(string(content)))
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(20 * time.Millisecond) {
+		// The orphaned child may linger as a zombie until its new parent reaps it.
+		stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(childPID), "stat"))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Child process %d of the killed command is still running", childPID)
+		}
+	}
+}
+
+// TestRunProcessCancelled checks that cancelling the context stops a command
+// and that a command is not started once the context is done.
+func TestRunProcessCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err := runProcess(ctx, exec.Command("sleep", "30")); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, Got: %v", err)
+	}
+
+	cmd := exec.Command("true")
+	if err := runProcess(ctx, cmd); err != context.Canceled || cmd.Process != nil {
+		t.Errorf("Expected the command not to start, Got: %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// procfileKillGrace is how long the processes of a Procfile are given to exit
+// after SIGTERM before they are sent SIGKILL.
+const procfileKillGrace = 5 * time.Second
+
+// procfileColors are the ANSI colours of the output prefixes, in turn.
+var procfileColors = []string{"36", "33", "32", "35", "34", "31"}
+
+// procfileLineRegex matches a `<name>: <command>` line of a Procfile.
+var procfileLineRegex = regexp.MustCompile(`^([A-Za-z0-9_-]+):\s*(.+)$`)
+
+// procfileEntry is a process declared in a Procfile.
+type procfileEntry struct {
+	name    string
+	command string
+}
+
+// parseProcfile reads the processes of a Procfile: `<name>: <command>` lines,
+// with empty lines and `#` comments ignored.
+func parseProcfile(r io.Reader) ([]procfileEntry, error) {
+	var entries []procfileEntry
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		matches := procfileLineRegex.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("malformed line %d: expected '<name>: <command>'", lineNum)
+		}
+		if seen[matches[1]] {
+			return nil, fmt.Errorf("duplicate process '%s' on line %d", matches[1], lineNum)
+		}
+		seen[matches[1]] = true
+		entries = append(entries, procfileEntry{name: matches[1], command: matches[2]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no processes declared")
+	}
+	return entries, nil
+}
+
+// procfileRunner runs the processes of a Procfile under one environment, each
+// with `bash -c` in a process group of its own, and prefixes every line they
+// write with the process name.
+type procfileRunner struct {
+	entries     []procfileEntry
+	env         []string // "KEY=VALUE" pairs.
+	cmdExecutor commandExecutor
+	out         io.Writer // Where the prefixed output of all processes goes.
+	color       bool      // Whether to colour the prefixes.
+	// keepGoing keeps the other processes running when one exits; otherwise
+	// they are all stopped.
+	keepGoing bool
+	grace     time.Duration
+}
+
+// procExit is the exit of the i-th process of a procfileRunner.
+type procExit struct {
+	i      int
+	status int
+}
+
+// run starts all processes and waits until they have exited. Ctrl-C (SIGINT)
+// or SIGTERM stops them all gracefully, and a second one kills them; other
+// forwarded signals are passed on to every process. It returns the exit status
+// of the first process to exit (with keepGoing, the first non-zero one), or
+// 128+n after signal n.
+func (p *procfileRunner) run() (int, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	var outMu sync.Mutex // Keeps the lines of different processes whole.
+	width := 0
+	for _, entry := range p.entries {
+		if len(entry.name) > width {
+			width = len(entry.name)
+		}
+	}
+
+	pids := make([]int, len(p.entries))
+	exited := make([]bool, len(p.entries))
+	exits := make(chan procExit, len(p.entries))
+	// signalAll sends sig to the process group of every running process.
+	signalAll := func(sig syscall.Signal) {
+		for i, pid := range pids {
+			if pid != 0 && !exited[i] {
+				syscall.Kill(-pid, sig)
+			}
+		}
+	}
+
+	for i, entry := range p.entries {
+		prefix := fmt.Sprintf("%-*s | ", width, entry.name)
+		if p.color {
+			prefix = "\x1b[" + procfileColors[i%len(procfileColors)] + "m" + prefix + "\x1b[0m"
+		}
+		out := &prefixWriter{prefix: prefix, out: p.out, mu: &outMu}
+
+		cmd := p.cmdExecutor(defaultShell, "-c", entry.command)
+		cmd.Env = p.env
+		cmd.Stdout, cmd.Stderr = out, out
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		if err := cmd.Start(); err != nil {
+			signalAll(syscall.SIGKILL)
+			return 0, fmt.Errorf("could not start process '%s': %w", entry.name, err)
+		}
+		pids[i] = cmd.Process.Pid
+		go func(i int) {
+			status, _ := exitStatus(cmd, cmd.Wait())
+			out.flush()
+			exits <- procExit{i: i, status: status}
+		}(i)
+	}
+
+	status, haveStatus := 0, false
+	stopping := false
+	var kill <-chan time.Time // Set once the processes are being stopped.
+	stopAll := func(reason string) {
+		fmt.Fprintf(os.Stderr, " » setnv: %s; stopping all processes.\n", reason)
+		stopping = true
+		signalAll(syscall.SIGTERM)
+		kill = time.After(p.grace)
+	}
+
+	for running := len(p.entries); running > 0; {
+		select {
+		case e := <-exits:
+			running--
+			exited[e.i] = true
+			if !haveStatus && (!p.keepGoing || e.status != 0) {
+				status, haveStatus = e.status, true
+			}
+			reason := fmt.Sprintf("'%s' exited with status %d", p.entries[e.i].name, e.status)
+			if !stopping && !p.keepGoing && running > 0 {
+				stopAll(reason)
+			} else {
+				fmt.Fprintf(os.Stderr, " » setnv: %s.\n", reason)
+			}
+		case sig := <-signals:
+			switch {
+			case sig != syscall.SIGINT && sig != syscall.SIGTERM:
+				signalAll(sig.(syscall.Signal))
+			case !stopping:
+				status, haveStatus = 128+int(sig.(syscall.Signal)), true
+				stopAll(fmt.Sprintf("Received %s", sig))
+			default:
+				signalAll(syscall.SIGKILL) // Asked twice.
+			}
+		case <-kill:
+			signalAll(syscall.SIGKILL)
+		}
+	}
+	return status, nil
+}
+
+// prefixWriter writes every complete line written to it to out, preceded by
+// prefix. A final line without a newline is written by flush.
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	mu     *sync.Mutex // Shared by the prefixWriters of all processes.
+
+	buf bytes.Buffer // The incomplete last line.
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.writeLine(w.buf.Next(i + 1))
+	}
+}
+
+// flush writes the incomplete last line, if any.
+func (w *prefixWriter) flush() {
+	if w.buf.Len() > 0 {
+		w.writeLine(append(w.buf.Next(w.buf.Len()), '\n'))
+	}
+}
+
+func (w *prefixWriter) writeLine(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	io.WriteString(w.out, w.prefix)
+	w.out.Write(line)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseProcfile(t *testing.T) {
+	entries, err := parseProcfile(strings.NewReader("# Processes\nweb: go run . -port $PORT\n\nworker:bundle exec sidekiq\n"))
+	expected := []procfileEntry{{"web", "go run . -port $PORT"}, {"worker", "bundle exec sidekiq"}}
+	if err != nil || !reflect.DeepEqual(entries, expected) {
+		t.Errorf("parseProcfile() = %v, %v; expected %v", entries, err, expected)
+	}
+
+	for _, content := range []string{"", "# Nothing\n", "web go run .\n", "web: a\nweb: b\n"} {
+		if _, err := parseProcfile(strings.NewReader(content)); err == nil {
+			t.Errorf("parseProcfile(%q): expected an error", content)
+		}
+	}
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := &prefixWriter{prefix: "web | ", out: &out, mu: &sync.Mutex{}}
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	w.flush()
+	if expected := "web | one\nweb | two\nweb | three\n"; out.String() != expected {
+		t.Errorf("Expected %q, Got %q", expected, out.String())
+	}
+}
+
+// TestProcfileRunner checks that the processes share the environment and that
+// the first to exit stops the others, unless keepGoing is set.
+func TestProcfileRunner(t *testing.T) {
+	tests := []struct {
+		keepGoing      bool
+		expectedStatus int
+		expectedOutput []string
+	}{
+		{false, 3, []string{"fast | fast bar", "slow | slow bar"}},
+		{true, 3, []string{"fast | fast bar", "slow | done", "slow | slow bar"}},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		runner := &procfileRunner{
+			entries: []procfileEntry{
+				{"fast", "echo fast $FOO; sleep 0.2; exit 3"},
+				{"slow", "echo slow $FOO; sleep 1; echo done"},
+			},
+			env:         []string{"FOO=bar"},
+			cmdExecutor: defaultCommandExecutor,
+			out:         &out,
+			keepGoing:   tt.keepGoing,
+			grace:       time.Second,
+		}
+
+		start := time.Now()
+		status, err := runner.run()
+		if err != nil || status != tt.expectedStatus {
+			t.Errorf("keepGoing=%v: run() = %d, %v; expected %d", tt.keepGoing, status, err, tt.expectedStatus)
+		}
+		if !tt.keepGoing && time.Since(start) > 900*time.Millisecond {
+			t.Errorf("Expected the slow process to be stopped, took %v", time.Since(start))
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		sort.Strings(lines) // The processes run concurrently.
+		if !reflect.DeepEqual(lines, tt.expectedOutput) {
+			t.Errorf("keepGoing=%v: expected output %q, Got %q", tt.keepGoing, tt.expectedOutput, lines)
+		}
+	}
+}
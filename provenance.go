@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// definition is an entry of a .env file, as `setnv explain` and
+// `--view --provenance` report it.
+type definition struct {
+	key         string
+	envFilePath string
+	lineNum     int
+	value       string // As written, before expansion and substitution.
+}
+
+// location returns where d is, e.g. "/home/me/dev.env:4".
+func (d definition) location() string {
+	if d.envFilePath == envOverridesSource {
+		return fmt.Sprintf("-e #%d", d.lineNum)
+	}
+	return absPath(d.envFilePath) + ":" + strconv.Itoa(d.lineNum)
+}
+
+// collectDefinitions returns every definition in the chained .env files at
+// envFilePaths and then in the `-e` overrides, in the order they are resolved.
+// Nothing is resolved, so no command is run and no secret is looked up.
+func collectDefinitions(envFilePaths []string, overrides []string) ([]definition, error) {
+	var definitions []definition
+	collect := func(lines []string, envFilePath string) {
+		var directives entryOptions
+		for i, line := range lines {
+			entry, ok := parseEnvLine(line, i+1, envFilePath, &directives, io.Discard)
+			if !ok {
+				continue
+			}
+			value := strings.ReplaceAll(entry.value, literalDollarPlaceholder, `\$`)
+			if entry.opts.asFile {
+				value = secretFilePrefix + value
+			}
+			definitions = append(definitions, definition{key: entry.key, envFilePath: envFilePath, lineNum: entry.lineNum, value: value})
+		}
+	}
+	for _, envFilePath := range envFilePaths {
+		lines, err := readEnvFileLines(envFilePath)
+		if err != nil {
+			return nil, err
+		}
+		collect(lines, envFilePath)
+	}
+	collect(overrides, envOverridesSource)
+	return definitions, nil
+}
+
+// provenance answers where the variables defined by a list of definitions
+// come from, on top of the inherited environment.
+type provenance struct {
+	definitions []definition
+	inherited   map[string]string
+}
+
+// latest returns the index of the last definition of key before the index
+// before, and false if there is none.
+func (p *provenance) latest(key string, before int) (int, bool) {
+	for i := before - 1; i >= 0; i-- {
+		if p.definitions[i].key == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// overridden describes what the latest definition of key overrides: earlier
+// definitions, latest first, and the inherited value. It returns nil if key is
+// defined once and not inherited.
+func (p *provenance) overridden(key string) []string {
+	i, ok := p.latest(key, len(p.definitions))
+	if !ok {
+		return nil
+	}
+	var descriptions []string
+	for {
+		if i, ok = p.latest(key, i); !ok {
+			break
+		}
+		descriptions = append(descriptions, p.definitions[i].location())
+	}
+	if _, ok := p.inherited[key]; ok {
+		descriptions = append(descriptions, "the inherited environment")
+	}
+	return descriptions
+}
+
+// summary returns a one-line provenance of key for `--view --provenance`,
+// e.g. "/home/me/dev.env:4, overrides /home/me/base.env:2".
+func (p *provenance) summary(key string) string {
+	i, ok := p.latest(key, len(p.definitions))
+	if !ok {
+		return "inherited"
+	}
+	summary := p.definitions[i].location()
+	if overridden := p.overridden(key); len(overridden) > 0 {
+		summary += ", overrides " + strings.Join(overridden, ", ")
+	}
+	return summary
+}
+
+// explain writes the provenance of key to w: the definition that sets it,
+// its raw value, what it depends on, and what it overrides. It reports false
+// if key is neither defined nor inherited.
+func (p *provenance) explain(w io.Writer, key string) bool {
+	i, ok := p.latest(key, len(p.definitions))
+	if !ok {
+		if _, inherited := p.inherited[key]; inherited {
+			fmt.Fprintf(w, "%s\n  Inherited from the environment; not defined in any .env file.\n", key)
+			return true
+		}
+		fmt.Fprintf(w, "%s\n  Not defined in any .env file or the environment.\n", key)
+		return false
+	}
+	d := p.definitions[i]
+	fmt.Fprintf(w, "%s\n  Defined at:  %s\n  Raw value:   %s\n", key, d.location(), d.value)
+
+	var dependencies []string
+	seen := make(map[string]bool)
+	for _, matches := range variableExpansionRegex.FindAllStringSubmatch(d.value, -1) {
+		name := matches[1] + matches[2] // One of the groups is empty.
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		origin := "not defined, expands to an empty string"
+		if j, ok := p.latest(name, i); ok {
+			origin = p.definitions[j].location()
+		} else if _, ok := p.inherited[name]; ok {
+			origin = "inherited"
+		}
+		dependencies = append(dependencies, fmt.Sprintf("$%s (%s)", name, origin))
+	}
+	for _, matches := range secretRefRegex.FindAllStringSubmatch(d.value, -1) {
+		dependencies = append(dependencies, "secret "+parseSecretRef(matches[1], matches[2]).String())
+	}
+	for _, matches := range alternateCommandRegex.FindAllStringSubmatch(d.value, -1) {
+		dependencies = append(dependencies, "command "+matches[1])
+	}
+	for _, matches := range genericCommandRegex.FindAllStringSubmatch(d.value, -1) {
+		dependencies = append(dependencies, "command "+matches[1])
+	}
+	if len(dependencies) > 0 {
+		fmt.Fprintf(w, "  Depends on:  %s\n", strings.Join(dependencies, "\n               "))
+	}
+	if overridden := p.overridden(key); len(overridden) > 0 {
+		fmt.Fprintf(w, "  Overrides:   %s\n", strings.Join(overridden, "\n               "))
+	}
+	return true
+}
+
+// runExplainCommand implements `setnv explain <id>[,<id2>,...] [<KEY>...]`:
+// it explains where each KEY, or every variable of the files, comes from.
+func runExplainCommand(args []string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: setnv explain <id>[,<id2>,...] [<KEY>...]")
+	}
+	envFilePaths, err := findChainedEnvFiles(args[0])
+	if err != nil {
+		return err
+	}
+	definitions, err := collectDefinitions(envFilePaths, nil)
+	if err != nil {
+		return err
+	}
+	p := &provenance{definitions: definitions, inherited: environMap()}
+
+	keys := args[1:]
+	if len(keys) == 0 {
+		seen := make(map[string]bool)
+		for _, d := range definitions {
+			if !seen[d.key] {
+				seen[d.key] = true
+				keys = append(keys, d.key)
+			}
+		}
+		sort.Strings(keys)
+	}
+	var undefined []string
+	for i, key := range keys {
+		if i > 0 {
+			fmt.Println()
+		}
+		if !p.explain(os.Stdout, key) {
+			undefined = append(undefined, key)
+		}
+	}
+	if len(undefined) > 0 {
+		return fmt.Errorf("not defined: %s", strings.Join(undefined, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvenance(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.env")
+	dev := filepath.Join(dir, "dev.env")
+	if err := os.WriteFile(base, []byte("HOST=localhost\nDATABASE_URL=postgres://localhost/app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dev, []byte("# Dev\nDB_PASS=${secret:gopass:dev/db#password}\nDATABASE_URL=\"postgres://$USER:$DB_PASS@$HOST/app?v=$[date +%s]\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	definitions, err := collectDefinitions([]string{base, dev}, []string{"HOST=db"})
+	if err != nil {
+		t.Fatalf("collectDefinitions returned error: %v", err)
+	}
+	if len(definitions) != 5 {
+		t.Fatalf("Expected 5 definitions, Got %+v", definitions)
+	}
+	p := &provenance{definitions: definitions, inherited: map[string]string{"USER": "me", "HOST": "box"}}
+
+	var out bytes.Buffer
+	if !p.explain(&out, "DATABASE_URL") {
+		t.Fatalf("Expected DATABASE_URL to be defined")
+	}
+	for _, expected := range []string{
+		"Defined at:  " + dev + ":3",
+		"Raw value:   postgres://$USER:$DB_PASS@$HOST/app?v=$[date +%s]",
+		"$USER (inherited)",
+		"$DB_PASS (" + dev + ":2)",
+		"$HOST (" + base + ":1)", // The override comes later.
+		"command date +%s",
+		"Overrides:   " + base + ":2",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected the explanation to contain %q, Got:\n%s", expected, out.String())
+		}
+	}
+	out.Reset()
+	p.explain(&out, "DB_PASS")
+	if !strings.Contains(out.String(), "secret gopass:dev/db#password") {
+		t.Errorf("Expected the secret reference as a dependency, Got:\n%s", out.String())
+	}
+
+	if summary, expected := p.summary("HOST"), "-e #1, overrides "+base+":1, the inherited environment"; summary != expected {
+		t.Errorf("Expected summary %q, Got %q", expected, summary)
+	}
+	if p.explain(&bytes.Buffer{}, "MISSING") {
+		t.Errorf("Expected MISSING to be undefined")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minRedactedLength is the length below which values are not redacted. Short
+// values such as "1" or "on" would mangle every message while revealing little.
+const minRedactedLength = 4
+
+// redactor knows the sensitive values resolved so far, i.e. the output of
+// substitutions and secret lookups, and removes them from diagnostics before
+// they are printed, so that failing commands or providers that echo a secret
+// do not leak it into CI logs. It is safe for concurrent use.
+type redactor struct {
+	mu     sync.Mutex
+	values map[string]bool
+}
+
+func newRedactor() *redactor {
+	return &redactor{values: make(map[string]bool)}
+}
+
+// add registers value as sensitive. Each line of a multi-line value (e.g., a
+// PEM key) is registered as well, in case it is printed on its own.
+func (rd *redactor) add(value string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	for _, v := range append(strings.Split(value, "\n"), value) {
+		v = strings.TrimSpace(v)
+		if len(v) >= minRedactedLength {
+			rd.values[v] = true
+		}
+	}
+}
+
+// sortedValues returns the sensitive values, longest first, so that a value
+// containing another is masked whole.
+func (rd *redactor) sortedValues() []string {
+	rd.mu.Lock()
+	values := make([]string, 0, len(rd.values))
+	for v := range rd.values {
+		values = append(values, v)
+	}
+	rd.mu.Unlock()
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	return values
+}
+
+// redact returns s with every sensitive value replaced by the mask.
+func (rd *redactor) redact(s string) string {
+	redacted, _ := redactPrefix(s, rd.sortedValues(), false)
+	return redacted
+}
+
+// redactPrefix masks the values in s, longest first. With holdBack, it stops
+// at the first position from which the rest of s could be the beginning of a
+// value, and returns the redacted part before it and the rest, unredacted.
+func redactPrefix(s string, values []string, holdBack bool) (redacted string, rest string) {
+	if len(values) == 0 {
+		return s, ""
+	}
+	var b strings.Builder
+	i := 0
+scan:
+	for i < len(s) {
+		for _, v := range values {
+			if strings.HasPrefix(s[i:], v) {
+				b.WriteString(maskedValue)
+				i += len(v)
+				continue scan
+			}
+			if holdBack && strings.HasPrefix(v, s[i:]) {
+				break scan
+			}
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String(), s[i:]
+}
+
+// writer returns a writer that redacts everything written to it before
+// passing it on to w. A value split across writes is masked as well: the end
+// of a write that could be the beginning of a value, at most the longest value
+// minus one byte, is held back until the next write or Flush.
+func (rd *redactor) writer(w io.Writer) *redactingWriter {
+	return &redactingWriter{rd: rd, w: w}
+}
+
+// redactingWriter is the writer returned by redactor.writer. It is safe for
+// concurrent use.
+type redactingWriter struct {
+	rd *redactor
+	w  io.Writer
+
+	mu      sync.Mutex
+	pending string // Held back by the last write.
+}
+
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	redacted, rest := redactPrefix(w.pending+string(p), w.rd.sortedValues(), true)
+	w.pending = rest
+	if _, err := io.WriteString(w.w, redacted); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes what was held back, redacted.
+func (w *redactingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	redacted := w.rd.redact(w.pending)
+	w.pending = ""
+	_, err := io.WriteString(w.w, redacted)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRedactor checks which values are masked in diagnostics.
+func TestRedactor(t *testing.T) {
+	rd := newRedactor()
+	if got := rd.redact("nothing to hide"); got != "nothing to hide" {
+		t.Errorf("redact with no values = %q", got)
+	}
+
+	rd.add("s3cret")
+	rd.add("s3cret-and-more")
+	rd.add("on") // Too short to redact.
+	rd.add("-----BEGIN KEY-----\nAbCdEfGh\n-----END KEY-----")
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"token s3cret rejected", "token **** rejected"},
+		{"got s3cret-and-more", "got ****"},
+		{"turned on", "turned on"},
+		{"bad key line: AbCdEfGh", "bad key line: ****"},
+	}
+	for _, tt := range tests {
+		if got := rd.redact(tt.input); got != tt.expected {
+			t.Errorf("redact(%q) = %q, expected %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+// TestRedactingWriter checks that values split across writes are masked, and
+// that only what could begin a value is held back.
+func TestRedactingWriter(t *testing.T) {
+	rd := newRedactor()
+	rd.add("s3cret-token")
+	var out bytes.Buffer
+	w := rd.writer(&out)
+
+	w.Write([]byte("error: s3c"))
+	if out.String() != "error: " {
+		t.Errorf("Expected the beginning of the value to be held back, Got %q", out.String())
+	}
+	w.Write([]byte("ret-token rejected, s"))
+	w.Write([]byte("ome text\nends with s3"))
+	if expected := "error: **** rejected, some text\nends with "; out.String() != expected {
+		t.Errorf("Expected %q, Got %q", expected, out.String())
+	}
+	w.Flush()
+	if expected := "error: **** rejected, some text\nends with s3"; out.String() != expected {
+		t.Errorf("Expected %q after Flush, Got %q", expected, out.String())
+	}
+}
+
+// TestParseEnvFileRedactsDiagnostics checks that resolved values do not appear
+// in warnings, whether in the failing command line or in its stderr, with
+// sequential and concurrent resolution.
+func TestParseEnvFileRedactsDiagnostics(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "redact.env")
+	envContent := `TOKEN=$(echo tok-12345)
+FAILS=$[test "Authorization: $TOKEN" = x || exit 7]
+ECHOES=$[echo "rejected tok-12345" >&2; exit 1]
+`
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	for _, jobs := range []int{1, 4} {
+		oldStderr := os.Stderr
+		r, w, _ := os.Pipe()
+		os.Stderr = w
+
+		envResolver := newResolver(defaultCommandExecutor)
+		envResolver.setJobs(jobs)
+		actualMap, err := envResolver.parseEnvFile(envFile, map[string]string{})
+
+		w.Close()
+		capturedStderr, _ := ioutil.ReadAll(r)
+		os.Stderr = oldStderr
+
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		if actualMap["TOKEN"] != "tok-12345" {
+			t.Errorf("jobs=%d: Expected TOKEN to resolve, Got %q", jobs, actualMap["TOKEN"])
+		}
+		stderr := string(capturedStderr)
+		if strings.Contains(stderr, "tok-12345") {
+			t.Errorf("jobs=%d: Secret leaked into diagnostics:\n%s", jobs, stderr)
+		}
+		if !strings.Contains(stderr, "Authorization: ****") || !strings.Contains(stderr, "rejected ****") {
+			t.Errorf("jobs=%d: Expected redacted warnings, Got:\n%s", jobs, stderr)
+		}
+	}
+}
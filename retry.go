@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRetryBackoff is the delay before the first retry when `@retry` or
+// --retry is given without a backoff. The delay doubles with every retry.
+// Retries apply to command substitutions and secret lookups alike.
+const defaultRetryBackoff = 500 * time.Millisecond
+
+// retryError is returned for a command that still failed after all retries.
+type retryError struct {
+	attempts []string // The outcome of each attempt: its exit code, or why it did not exit.
+	last     error    // The error of the last attempt.
+}
+
+func (e *retryError) Error() string {
+	for _, attempt := range e.attempts {
+		if _, err := strconv.Atoi(attempt); err != nil && attempt != "timeout" {
+			// Not a command, e.g. a secret provider: its last error says more.
+			return fmt.Sprintf("failed after %d attempts: %v", len(e.attempts), e.last)
+		}
+	}
+	return fmt.Sprintf("failed after %d attempts (exit codes: %s)", len(e.attempts), strings.Join(e.attempts, ", "))
+}
+
+func (e *retryError) Unwrap() error {
+	return e.last
+}
+
+// retryPolicy returns how often a failed command of an entry with opts is
+// retried, and the delay before the first retry: the entry's `# @retry`, or
+// else the --retry default.
+func (r *resolver) retryPolicy(opts entryOptions) (int, time.Duration) {
+	if opts.hasRetry {
+		return opts.retries, opts.backoff
+	}
+	return r.retries, r.retryBackoff
+}
+
+// withRetries calls run until it succeeds, or it has been retried retries
+// times, waiting backoff before the first retry and twice as long before each
+// following one. Nothing is retried once setnv is interrupted. When all attempts
+// fail, the error is a *retryError listing each attempt's outcome.
+func (r *resolver) withRetries(retries int, backoff time.Duration, run func() (string, error)) (string, error) {
+	var attempts []string
+	for attempt := 0; ; attempt++ {
+		output, err := run()
+		if err == nil {
+			return output, nil
+		}
+		if retries == 0 {
+			return "", err
+		}
+		attempts = append(attempts, attemptOutcome(err))
+		if attempt == retries || r.ctx.Err() != nil {
+			return "", &retryError{attempts: attempts, last: err}
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-r.ctx.Done():
+			return "", &retryError{attempts: attempts, last: err}
+		}
+		backoff *= 2
+	}
+}
+
+// attemptOutcome describes how a failed attempt ended, for retryError.
+func attemptOutcome(err error) string {
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &exitErr):
+		return strconv.Itoa(exitErr.ExitCode())
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return err.Error()
+}
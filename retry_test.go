@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParseEnvFileRetries checks that `# @retry` reruns failing commands, and
+// that the warning lists every attempt once the retries are exhausted.
+func TestParseEnvFileRetries(t *testing.T) {
+	dir := t.TempDir()
+	// flaky returns a command that exits with code <n> on its <n>th run, and
+	// prints name once it has run ok times. "times_out" hangs on its second run.
+	flaky := func(name string, ok int) string {
+		script := filepath.Join(dir, name+".sh")
+		content := fmt.Sprintf("n=$(cat %[1]s.count 2>/dev/null || echo 0); n=$((n+1)); echo $n > %[1]s.count\n[ $n -ge %[2]d ] && echo %[3]s || exit $n\n", filepath.Join(dir, name), ok, name)
+		if name == "times_out" {
+			content = strings.Replace(content, "|| exit $n", "|| { [ $n = 2 ] && sleep 5; exit $n; }", 1)
+		}
+		if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+			t.Fatalf("Failed to write script: %v", err)
+		}
+		return "bash " + script
+	}
+
+	envFile := filepath.Join(dir, "retry.env")
+	envContent := fmt.Sprintf(`# @retry 3 backoff=10ms
+RECOVERS=$[%s]
+# @retry 1 backoff=10ms
+GIVES_UP=$[%s]
+NO_RETRY=$[%s]
+# @retry 2 backoff=10ms
+# @timeout 200ms
+TIMES_OUT=$[%s]`, flaky("recovers", 3), flaky("gives_up", 5), flaky("no_retry", 5), flaky("times_out", 5))
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	oldStderr := os.Stderr
+	r, w, _ := os.Pipe()
+	os.Stderr = w
+	defer func() { os.Stderr = oldStderr }()
+
+	actualMap, err := parseEnvFile(envFile, defaultCommandExecutor, map[string]string{})
+
+	w.Close()
+	capturedStderr, _ := ioutil.ReadAll(r)
+	os.Stderr = oldStderr
+
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{"RECOVERS": "recovers", "GIVES_UP": "", "NO_RETRY": "", "TIMES_OUT": ""}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+
+	stderr := string(capturedStderr)
+	if !strings.Contains(stderr, "for variable 'GIVES_UP' on line 4 in '"+envFile+"' failed after 2 attempts (exit codes: 1, 2)") {
+		t.Errorf("Expected the exit code of each attempt, Got:\n%s", stderr)
+	}
+	if !strings.Contains(stderr, "for variable 'NO_RETRY' on line 5 in '"+envFile+"' failed with exit code 1") {
+		t.Errorf("Expected the directive to apply to the next entry only, Got:\n%s", stderr)
+	}
+	if !strings.Contains(stderr, "for variable 'TIMES_OUT' on line 8 in '"+envFile+"' failed after 3 attempts (exit codes: 1, timeout, 3)") {
+		t.Errorf("Expected the timed out attempt to be listed, Got:\n%s", stderr)
+	}
+}
+
+// TestWithRetriesBackoff checks the doubling delay between attempts.
+func TestWithRetriesBackoff(t *testing.T) {
+	r := newResolver(defaultCommandExecutor)
+	var calls []time.Time
+	_, err := r.withRetries(2, 50*time.Millisecond, func() (string, error) {
+		calls = append(calls, time.Now())
+		return "", fmt.Errorf("unavailable")
+	})
+	if err == nil || err.Error() != "failed after 3 attempts: unavailable" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first, second := calls[1].Sub(calls[0]), calls[2].Sub(calls[1]); first < 50*time.Millisecond || second < 100*time.Millisecond {
+		t.Errorf("Expected delays of at least 50ms and 100ms, Got %s and %s", first, second)
+	}
+}
+
+// TestSecretLookupRetries checks that --retry applies to secret lookups, and
+// that a Vault server error is asked again rather than shared.
+func TestSecretLookupRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"errors":["sealed"]}`)
+			return
+		}
+		fmt.Fprint(w, `{"data":{"data":{"password":"s3cret"},"metadata":{}}}`)
+	}))
+	t.Cleanup(server.Close)
+	env := map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"}
+
+	var diag bytes.Buffer
+	r := newResolver(defaultCommandExecutor)
+	r.retries, r.retryBackoff = 1, time.Millisecond
+	if value := r.applySecretReferences("${secret:vault:kv/data/app#password}", "A", "test.env", 1, entryOptions{}, env, nil, &diag); value != "" {
+		t.Errorf("Expected no value after 2 attempts, Got %q", value)
+	}
+	if !strings.Contains(diag.String(), "failed after 2 attempts: vault returned 503") {
+		t.Errorf("Expected the last error of the attempts, Got:\n%s", diag.String())
+	}
+
+	r = newResolver(defaultCommandExecutor)
+	r.retries, r.retryBackoff = 2, time.Millisecond
+	if value := r.applySecretReferences("${secret:vault:kv/data/app#password}", "A", "test.env", 1, entryOptions{}, env, nil, io.Discard); value != "s3cret" {
+		t.Errorf("Expected the third attempt to succeed, Got %q", value)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, Got %d", n)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultProviderTimeout bounds how long a secret provider may take to resolve
+// a single reference before it is abandoned.
+const defaultProviderTimeout = 30 * time.Second
+
+// secretRefRegex identifies `${secret:<scheme>:<path>[#<field>]}` references.
+// Group 1 captures the scheme (e.g., `gopass`, `file`).
+// Group 2 captures the provider-specific reference, including any `#field` suffix.
+var secretRefRegex = regexp.MustCompile(`\$\{secret:([a-zA-Z][a-zA-Z0-9_-]*):([^}]+)\}`)
+
+// secretRef is a parsed `${secret:<scheme>:<path>[#<field>]}` reference.
+type secretRef struct {
+	scheme string // The provider scheme, e.g. "gopass".
+	path   string // The provider-specific path, e.g. "myproject/db".
+	field  string // Optional field selector (the part after '#'), empty if not given.
+}
+
+// String renders the reference in its canonical `<scheme>:<path>[#<field>]`
+// form, escaping any '#' in the path.
+func (r secretRef) String() string {
+	path := strings.ReplaceAll(r.path, "#", `\#`)
+	if r.field == "" {
+		return r.scheme + ":" + path
+	}
+	return r.scheme + ":" + path + "#" + r.field
+}
+
+// parseSecretRef splits the scheme and reference captured by secretRefRegex
+// into a secretRef. The field selector is everything after the first '#'; a
+// '#' that belongs to the path is written `\#`, e.g. `${secret:file:/tmp/a\#b}`.
+func parseSecretRef(scheme, reference string) secretRef {
+	ref := secretRef{scheme: scheme}
+	path := strings.TrimSpace(reference)
+	for i := 0; i < len(path); i++ {
+		if strings.HasPrefix(path[i:], `\#`) {
+			i++
+		} else if path[i] == '#' {
+			ref.field = strings.TrimSpace(path[i+1:])
+			path = strings.TrimSpace(path[:i])
+			break
+		}
+	}
+	ref.path = strings.ReplaceAll(path, `\#`, "#")
+	return ref
+}
+
+// SecretProvider resolves `${secret:<scheme>:...}` references for one scheme.
+// Providers that shell out must use the given commandExecutor so that they can
+// be tested with the same mocks as command substitutions.
+type SecretProvider interface {
+	// Resolve returns the secret value for ref. env is the environment any
+	// helper command must be run with. The lookup must stop when ctx is done.
+	Resolve(ctx context.Context, ref secretRef, cmdExecutor commandExecutor, env map[string]string) (string, error)
+}
+
+// secretProviders holds the registered providers, keyed by scheme.
+var secretProviders = map[string]SecretProvider{}
+
+// registerSecretProvider makes p available under `${secret:<scheme>:...}`.
+// Registering a scheme twice replaces the earlier provider.
+func registerSecretProvider(scheme string, p SecretProvider) {
+	secretProviders[scheme] = p
+}
+
+func init() {
+	registerSecretProvider("gopass", gopassProvider{timeout: defaultProviderTimeout})
+	registerSecretProvider("pass", passProvider{timeout: defaultProviderTimeout})
+	registerSecretProvider("file", fileProvider{})
+	registerSecretProvider("vault", newVaultProvider(defaultProviderTimeout))
+}
+
+// resolveSecretRef looks up the provider registered for ref.scheme and resolves ref.
+func resolveSecretRef(ctx context.Context, ref secretRef, cmdExecutor commandExecutor, env map[string]string) (string, error) {
+	provider, ok := secretProviders[ref.scheme]
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider '%s'", ref.scheme)
+	}
+	return provider.Resolve(ctx, ref, cmdExecutor, env)
+}
+
+// batchSecretProvider is implemented by providers that can resolve several
+// references together more cheaply than one at a time, e.g. by fetching them
+// concurrently or in a single request.
+type batchSecretProvider interface {
+	SecretProvider
+	// ResolveBatch resolves refs and returns the values it could resolve.
+	// References missing from the result are later resolved individually, so
+	// that their errors are reported for the line that uses them.
+	ResolveBatch(ctx context.Context, refs []secretRef, cmdExecutor commandExecutor, env map[string]string) map[secretRef]string
+}
+
+// contextSecretProvider is implemented by providers whose lookups depend on
+// variables of the environment, such as the server to ask. Their values are
+// part of the key that lookups are memoized and cached by (see secretMemoKey).
+type contextSecretProvider interface {
+	SecretProvider
+	// ContextVars returns the names of the variables that select where, and
+	// as whom, secrets are looked up.
+	ContextVars() []string
+}
+
+// secretMemoKey is the substitutionMemo key of a secret reference resolved
+// with env: the reference, and the provider's context variables in env.
+func secretMemoKey(ref secretRef, env map[string]string) string {
+	key := "secret:" + ref.String()
+	if p, ok := secretProviders[ref.scheme].(contextSecretProvider); ok {
+		hash := sha256.New()
+		for _, name := range p.ContextVars() {
+			fmt.Fprintf(hash, "%s=%s\x00", name, env[name])
+		}
+		key += "|env:" + hex.EncodeToString(hash.Sum(nil)[:16])
+	}
+	return key
+}
+
+// secretBatch is the batched lookup of one scheme's references in a file. It
+// runs once, however many entries (possibly concurrently) need it.
+type secretBatch struct {
+	once   sync.Once
+	refs   []secretRef
+	values map[string]string // The values ResolveBatch could resolve, by secretMemoKey.
+}
+
+// batchableSecretRefs collects, per scheme, the distinct `${secret:...}`
+// references in lines whose provider supports batching. References built from
+// variables (containing `$`) are left out, as they are only known once expanded.
+func batchableSecretRefs(lines []string) map[string]*secretBatch {
+	batches := make(map[string]*secretBatch)
+	seen := make(map[secretRef]bool)
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, matches := range secretRefRegex.FindAllStringSubmatch(line, -1) {
+			if _, ok := secretProviders[matches[1]].(batchSecretProvider); !ok || strings.Contains(matches[2], "$") {
+				continue
+			}
+			ref := parseSecretRef(matches[1], matches[2])
+			if !seen[ref] {
+				seen[ref] = true
+				if batches[ref.scheme] == nil {
+					batches[ref.scheme] = &secretBatch{}
+				}
+				batches[ref.scheme].refs = append(batches[ref.scheme].refs, ref)
+			}
+		}
+	}
+	return batches
+}
+
+// batchedSecret returns the value of ref from the batch lookup of its scheme,
+// if the provider supports batching and could resolve ref. The batch runs when
+// the first reference of a scheme is needed, so it sees the variables defined
+// on the lines above it; its values are not used for references resolved with
+// other provider settings (e.g., VAULT_ADDR redefined on a later line).
+func (r *resolver) batchedSecret(ref secretRef, env map[string]string) (string, bool) {
+	batch, ok := r.pendingSecretRefs[ref.scheme]
+	if !ok {
+		return "", false
+	}
+	batch.once.Do(func() {
+		release := r.acquireJob()
+		defer release()
+		provider := secretProviders[ref.scheme].(batchSecretProvider)
+		values := provider.ResolveBatch(withVaultFetches(r.ctx, r.vaultFetches), batch.refs, r.cmdExecutor, env)
+		batch.values = make(map[string]string, len(values))
+		for ref, value := range values {
+			batch.values[secretMemoKey(ref, env)] = value
+		}
+	})
+	value, ok := batch.values[secretMemoKey(ref, env)]
+	return value, ok
+}
+
+// applySecretReferences replaces every `${secret:...}` reference in value with
+// the value returned by its provider. A reference that fails to resolve is
+// replaced with an empty string and reported as a warning. Each distinct
+// reference is resolved only once per invocation, within the entry's timeout,
+// retried according to the entry's retry policy, and read from the secret
+// cache if the entry has a `# @cache` TTL.
+//
+// Any `$` in a resolved secret is replaced with literalDollarPlaceholder so that
+// the later command substitution and expansion passes treat it literally.
+func (r *resolver) applySecretReferences(value, key, envFilePath string, lineNum int, opts entryOptions, inheritedEnvMap map[string]string, currentEnvMap map[string]string, diag io.Writer) string {
+	return secretRefRegex.ReplaceAllStringFunc(value, func(matchStr string) string {
+		matches := secretRefRegex.FindStringSubmatch(matchStr)
+		if len(matches) < 3 { // Should not happen if regex matched
+			return matchStr
+		}
+		ref := parseSecretRef(matches[1], matches[2])
+		env := mergeMaps(inheritedEnvMap, currentEnvMap)
+		if ref.scheme == "file" {
+			r.recordSecretFile(ref.path)
+		}
+
+		memoKey := secretMemoKey(ref, env)
+		output, err := r.memo.do(memoKey, func() (string, error) {
+			return r.withCache(memoKey, fmt.Sprintf("secret '%s'", ref), key, lineNum, envFilePath, opts, diag, func() (string, error) {
+				if output, ok := r.batchedSecret(ref, env); ok {
+					return output, nil
+				}
+				retries, backoff := r.retryPolicy(opts)
+				return r.withRetries(retries, backoff, func() (string, error) {
+					release := r.acquireJob()
+					defer release()
+					timeout := r.commandTimeout(opts)
+					ctx, cancel := withTimeout(r.ctx, timeout)
+					defer cancel()
+					output, err := resolveSecretRef(withVaultFetches(ctx, r.vaultFetches), ref, r.cmdExecutor, env)
+					if err != nil && ctx.Err() == context.DeadlineExceeded {
+						return "", timeoutError{fmt.Sprintf("timed out after %s", timeout)}
+					}
+					return output, err
+				})
+			})
+		})
+		if err != nil {
+			fmt.Fprintf(diag, " » setnv: Warning: could not resolve secret '%s' for variable '%s' on line %d in '%s': %v. Value set to empty.\n", ref, key, lineNum, envFilePath, err)
+			return ""
+		}
+		if output == "" {
+			fmt.Fprintf(diag, " » setnv: Warning: secret '%s' for variable '%s' returned an empty value on line %d in '%s'.\n", ref, key, lineNum, envFilePath)
+		}
+		r.redactor.add(output)
+		return strings.ReplaceAll(output, "$", literalDollarPlaceholder)
+	})
+}
+
+// runProviderCommand runs name with args through cmdExecutor, using env as the
+// command's environment, and returns its standard output. The command is killed
+// if it does not finish within timeout (zero means no limit) or when ctx is
+// done. On failure, the returned error carries the command's trimmed standard error.
+func runProviderCommand(ctx context.Context, cmdExecutor commandExecutor, env map[string]string, timeout time.Duration, name string, args ...string) (string, error) {
+	cmd := cmdExecutor(name, args...)
+	cmd.Env = mapToSlice(env)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := runProcess(ctx, cmd); err != nil {
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return "", timeoutError{fmt.Sprintf("'%s' timed out after %s", name, timeout)}
+		case ctx.Err() != nil:
+			return "", fmt.Errorf("'%s' was interrupted", name)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("'%s' failed: %v: %s", name, err, msg)
+		}
+		return "", fmt.Errorf("'%s' failed: %v", name, err)
+	}
+	return strings.TrimSuffix(stdout.String(), "\n"), nil
+}
+
+// gopassProvider resolves `${secret:gopass:<path>[#<field>]}` by running
+// `gopass show --password <path>`, or `gopass show <path> <field>` when a
+// field such as `username` or `url` is selected.
+type gopassProvider struct {
+	timeout time.Duration
+}
+
+func (gopassProvider) ContextVars() []string {
+	return []string{"PASSWORD_STORE_DIR", "GOPASS_HOMEDIR", "GOPASS_CONFIG"}
+}
+
+func (p gopassProvider) Resolve(ctx context.Context, ref secretRef, cmdExecutor commandExecutor, env map[string]string) (string, error) {
+	output, err := runProviderCommand(ctx, cmdExecutor, env, p.timeout, "gopass", gopassShowArgs(nil, ref.path, ref.field)...)
+	if err != nil {
+		return "", fmt.Errorf("%v (does the gopass secret exist?)", err)
+	}
+	return output, nil
+}
+
+// gopassShowArgs builds the `gopass show` arguments for path. Flags (e.g., `-o`)
+// and a key are passed through as given. Without either, only the password is
+// requested, which is what `$(gopass show <path>)` has always returned.
+func gopassShowArgs(flags []string, path, key string) []string {
+	args := []string{"show"}
+	if len(flags) == 0 && key == "" {
+		return append(args, "--password", path)
+	}
+	args = append(args, flags...)
+	args = append(args, path)
+	if key != "" {
+		args = append(args, key)
+	}
+	return args
+}
+
+// passProvider resolves `${secret:pass:<path>[#<field>]}` using `pass show <path>`
+// from the standard Unix password store. Without a field, the first line of the
+// entry (the password) is returned. With a field, the entry body is searched for
+// a `<field>: <value>` line, matching the field name case-insensitively.
+type passProvider struct {
+	timeout time.Duration
+}
+
+func (passProvider) ContextVars() []string {
+	return []string{"PASSWORD_STORE_DIR"}
+}
+
+func (p passProvider) Resolve(ctx context.Context, ref secretRef, cmdExecutor commandExecutor, env map[string]string) (string, error) {
+	output, err := runProviderCommand(ctx, cmdExecutor, env, p.timeout, "pass", "show", ref.path)
+	if err != nil {
+		if strings.Contains(err.Error(), "is not in the password store") {
+			return "", fmt.Errorf("pass entry '%s' does not exist", ref.path)
+		}
+		return "", fmt.Errorf("%v (is the password store unlocked?)", err)
+	}
+	return passEntryField(output, ref)
+}
+
+// passEntryField extracts the password (first line) or the named field from the
+// multi-line body of a pass entry.
+func passEntryField(entry string, ref secretRef) (string, error) {
+	lines := strings.Split(entry, "\n")
+	if ref.field == "" {
+		return lines[0], nil
+	}
+	for _, line := range lines[1:] {
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), ref.field) {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("field '%s' not found in pass entry '%s'", ref.field, ref.path)
+}
+
+// fileProvider resolves `${secret:file:<path>}` by reading the file at <path>,
+// as used by Docker and Kubernetes secret mounts. A single trailing newline is
+// removed from the contents.
+type fileProvider struct{}
+
+func (fileProvider) Resolve(_ context.Context, ref secretRef, _ commandExecutor, _ map[string]string) (string, error) {
+	if ref.field != "" {
+		return "", fmt.Errorf("file provider does not support field selection ('#%s'); write a '#' in the path as '\\#'", ref.field)
+	}
+	content, err := os.ReadFile(ref.path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(content), "\n"), nil
+}
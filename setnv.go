@@ -2,15 +2,21 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -37,9 +43,9 @@ type commandExecutor func(name string, arg ...string) *exec.Cmd
 // defaultCommandExecutor is the actual `os/exec.Command` function used in production.
 var defaultCommandExecutor commandExecutor = exec.Command
 
-// gopassRegex identifies `$(gopass show <path>)` patterns for specific handling.
-// It captures the path as the first group.
-var gopassRegex = regexp.MustCompile(`\$\(gopass(?: show)?(?:(?:\s+[-]{1,2}[a-zA-Z0-9_]+(?:[^)\s]+)?)*)\s*([^)]+)\)`)
+// gopassRegex identifies `$(gopass show [flags] <path> [key])` patterns for specific handling.
+// Group 1 captures any flags (e.g., ` -o`), group 2 captures the path and optional key.
+var gopassRegex = regexp.MustCompile(`\$\(gopass(?: show)?((?:\s+[-]{1,2}[a-zA-Z0-9_]+(?:[^)\s]+)?)*)\s*([^)]+)\)`)
 
 // alternateCommandRegex identifies any `$[command args...]` pattern.
 // It captures the entire command string inside the brackets as the first group.
@@ -55,30 +61,140 @@ var genericCommandRegex = regexp.MustCompile(`\$\(([^)]+)\)`)
 // Group 2 captures the variable name for `${VAR}` (e.g., `VAR_NAME`).
 var variableExpansionRegex = regexp.MustCompile(`\$(?:([a-zA-Z_][a-zA-Z0-9_]*)|{([a-zA-Z_][a-zA-Z0-9_]*)})`)
 
+// resolver resolves the .env files of one setnv invocation. State that must be
+// shared by all chained files, such as memoized command output, lives here.
+type resolver struct {
+	cmdExecutor commandExecutor
+	memo        *substitutionMemo
+
+	// ctx stops all running substitutions when done, e.g. on Ctrl-C.
+	ctx context.Context
+	// cmdTimeout limits each substitution of entries without `# @timeout`
+	// (see commandTimeout). Zero means no limit.
+	cmdTimeout time.Duration
+	// retries and retryBackoff are the retry policy of entries without
+	// `# @retry` (see retryPolicy). Zero retries means failures are final.
+	retries      int
+	retryBackoff time.Duration
+	// cache stores the results of entries with a `# @cache` TTL across
+	// invocations; nil with --no-cache.
+	cache *secretCache
+
+	// jobs is the maximum number of substitutions run at the same time; with 1,
+	// entries are resolved strictly in file order. slots holds one token per
+	// running substitution when jobs > 1 (see setJobs and acquireJob).
+	jobs  int
+	slots chan struct{}
+
+	// sensitive records, per variable, whether its latest definition holds a
+	// value derived from a substitution (see markSensitive).
+	sensitive map[string]bool
+	// defined and redefined record the variables the files parsed so far
+	// define, and those among them that change a value that was already set
+	// (see markRedefinitions).
+	defined, redefined map[string]bool
+	// asFile records, per variable, whether its latest definition has the
+	// `@file:` prefix (see fileVars).
+	asFile map[string]bool
+	// secretFilePaths holds the files read by `${secret:file:...}` references
+	// (see secretFiles), guarded by secretFilePathsMu.
+	secretFilePathsMu sync.Mutex
+	secretFilePaths   map[string]bool
+	// preExecHooks and postExecHooks are the exec hooks declared in the files
+	// parsed so far, in order (see execHook).
+	preExecHooks  []execHook
+	postExecHooks []execHook
+	// redactor removes the values of substitutions from all diagnostics.
+	redactor *redactor
+
+	// pendingSecretRefs holds, per scheme, the `${secret:...}` references of the
+	// file being parsed that can be looked up in one batch (see batchedSecret).
+	pendingSecretRefs map[string]*secretBatch
+	// vaultFetches are the Vault secrets read by this resolver (see withVaultFetches).
+	vaultFetches *vaultFetches
+}
+
+// newResolver returns a resolver that runs commands through cmdExecutor,
+// one at a time.
+func newResolver(cmdExecutor commandExecutor) *resolver {
+	return &resolver{
+		cmdExecutor: cmdExecutor,
+		memo:        newSubstitutionMemo(),
+		sensitive:   make(map[string]bool),
+		defined:     make(map[string]bool),
+		redefined:   make(map[string]bool),
+		asFile:      make(map[string]bool),
+
+		secretFilePaths: make(map[string]bool),
+		redactor:        newRedactor(),
+		vaultFetches:    newVaultFetches(),
+		ctx:             context.Background(),
+		jobs:            1,
+	}
+}
+
+// setJobs sets the maximum number of substitutions run at the same time.
+func (r *resolver) setJobs(jobs int) {
+	r.jobs = jobs
+	r.slots = nil
+	if jobs > 1 {
+		r.slots = make(chan struct{}, jobs)
+	}
+}
+
+// commandTimeout returns the timeout for each substitution of an entry with
+// opts: its `# @timeout`, or else the --cmd-timeout default.
+func (r *resolver) commandTimeout(opts entryOptions) time.Duration {
+	if opts.hasTimeout {
+		return opts.timeout
+	}
+	return r.cmdTimeout
+}
+
+// acquireJob waits until another substitution may run and returns the
+// function that releases its slot again.
+func (r *resolver) acquireJob() (release func()) {
+	if r.slots == nil {
+		return func() {}
+	}
+	r.slots <- struct{}{}
+	return func() { <-r.slots }
+}
+
+// envEntry is a `KEY=VALUE` line of a .env file, with its value unquoted but
+// not yet expanded or substituted.
+type envEntry struct {
+	key     string
+	value   string
+	lineNum int
+	opts    entryOptions // From the directive comments above the entry.
+}
+
 // applyCommandSubstitution replaces command substitution patterns (e.g., $(...) or $[...])
 // in the given value string using the provided regex.
-func applyCommandSubstitution(
+func (r *resolver) applyCommandSubstitution(
 	value string,
-	r *regexp.Regexp, // The regex to use (genericCommandRegex or alternateCommandRegex)
+	re *regexp.Regexp, // The regex to use (genericCommandRegex or alternateCommandRegex)
 	key string,
 	envFilePath string,
 	lineNum int,
-	cmdExecutor commandExecutor,
+	opts entryOptions,
 	inheritedEnvMap map[string]string,
 	initialEnvMap map[string]string,
 	combinedEnvForLookup map[string]string,
+	diag io.Writer, // Where warnings about this entry are written.
 ) string {
-	return r.ReplaceAllStringFunc(value, func(matchStr string) string {
-		matches := r.FindStringSubmatch(matchStr)
+	return re.ReplaceAllStringFunc(value, func(matchStr string) string {
+		matches := re.FindStringSubmatch(matchStr)
 		if len(matches) < 2 || matches[1] == "" { // Should not happen if regex matched correctly and captured
-			fmt.Fprintf(os.Stderr, " » setnv: Warning: Command substitution regex matched but failed to extract command for variable '%s' on line %d in '%s'. Match: '%s'.\n", key, lineNum, envFilePath, matchStr)
+			fmt.Fprintf(diag, " » setnv: Warning: Command substitution regex matched but failed to extract command for variable '%s' on line %d in '%s'. Match: '%s'.\n", key, lineNum, envFilePath, matchStr)
 			return matchStr // Return original match if command extraction fails
 		}
 		commandToExecute := matches[1]
 
-		output, err := executeCommandSubstitution(key, commandToExecute, envFilePath, lineNum, cmdExecutor, inheritedEnvMap, initialEnvMap)
+		output, err := r.executeCommandSubstitution(key, commandToExecute, envFilePath, lineNum, opts, inheritedEnvMap, initialEnvMap, diag)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, " » setnv: Warning: %v. Value set to empty.\n", err)
+			fmt.Fprintf(diag, " » setnv: Warning: %v. Value set to empty.\n", err)
 			return ""
 		}
 
@@ -87,7 +203,7 @@ func applyCommandSubstitution(
 		output = expandVarsInString(output, combinedEnvForLookup)
 
 		if output == "" {
-			fmt.Fprintf(os.Stderr, " » setnv: Warning: command '%s' for variable '%s' returned an empty value on line %d in '%s'.\n", commandToExecute, key, lineNum, envFilePath)
+			fmt.Fprintf(diag, " » setnv: Warning: command '%s' for variable '%s' returned an empty value on line %d in '%s'.\n", commandToExecute, key, lineNum, envFilePath)
 		}
 		return output
 	})
@@ -95,10 +211,44 @@ func applyCommandSubstitution(
 
 // executeCommandSubstitution runs a command string using the default shell
 // and returns its standard output.
-// It also directs the command's standard error to setnv's standard error.
-func executeCommandSubstitution(key, commandString, envFilePath string, lineNum int, cmdExecutor commandExecutor, inheritedEnvMap map[string]string, currentEnvMap map[string]string) (string, error) {
-	cmd := cmdExecutor(defaultShell, "-c", commandString)
-	cmd.Stderr = os.Stderr // Direct command's stderr to `setnv`'s stderr for visibility.
+// It also directs the command's standard error to stderr, the entry's diagnostics.
+// The output is registered with the redactor.
+// Identical command strings are only run once per invocation with the same
+// environment (see substitutionMemo).
+// The command is killed when it exceeds the entry's timeout or setnv is interrupted,
+// and retried according to the entry's retry policy. Entries with a `# @cache`
+// TTL read and store the output in the secret cache.
+func (r *resolver) executeCommandSubstitution(key, commandString, envFilePath string, lineNum int, opts entryOptions, inheritedEnvMap map[string]string, currentEnvMap map[string]string, stderr io.Writer) (string, error) {
+	memoKey := "cmd:" + commandString + "|env:" + r.envKey(mergeMaps(inheritedEnvMap, currentEnvMap))
+	output, err := r.memo.do(memoKey, func() (string, error) {
+		return r.withCache(memoKey, fmt.Sprintf("command '%s'", commandString), key, lineNum, envFilePath, opts, stderr, func() (string, error) {
+			retries, backoff := r.retryPolicy(opts)
+			return r.withRetries(retries, backoff, func() (string, error) {
+				release := r.acquireJob()
+				defer release()
+				return r.runSubstitutionCommand(commandString, r.commandTimeout(opts), inheritedEnvMap, currentEnvMap, stderr)
+			})
+		})
+	})
+	if err != nil {
+		if retryErr, ok := err.(*retryError); ok {
+			return "", fmt.Errorf(" » command '%s' for variable '%s' on line %d in '%s' %v", commandString, key, lineNum, envFilePath, retryErr)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			// Include stderr output from the failed command in the error message
+			return "", fmt.Errorf(" » command '%s' for variable '%s' on line %d in '%s' failed with exit code %d: %s", commandString, key, lineNum, envFilePath, exitErr.ExitCode(), string(exitErr.Stderr))
+		}
+		return "", fmt.Errorf(" » failed to execute command substitution for variable '%s' on line %d in '%s': %w", key, lineNum, envFilePath, err)
+	}
+	r.redactor.add(output)
+	return output, nil
+}
+
+// runSubstitutionCommand runs commandString with `bash -c` and returns its
+// standard output without the trailing newline.
+func (r *resolver) runSubstitutionCommand(commandString string, timeout time.Duration, inheritedEnvMap map[string]string, currentEnvMap map[string]string, stderr io.Writer) (string, error) {
+	cmd := r.cmdExecutor(defaultShell, "-c", commandString)
+	cmd.Stderr = stderr // Direct command's stderr to `setnv`'s stderr for visibility.
 
 	// Build the environment for the sub-command.
 	// `subCmdEnvMap` is the environment that the executed command (e.g., `bash -c ...`) will inherit.
@@ -119,42 +269,142 @@ func executeCommandSubstitution(key, commandString, envFilePath string, lineNum
 
 	cmd.Env = subCmdEnvSlice
 
-	output, err := cmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			// Include stderr output from the failed command in the error message
-			return "", fmt.Errorf(" » command '%s' for variable '%s' on line %d in '%s' failed with exit code %d: %s", commandString, key, lineNum, envFilePath, exitErr.ExitCode(), string(exitErr.Stderr))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+
+	ctx, cancel := withTimeout(r.ctx, timeout)
+	defer cancel()
+	if err := runProcess(ctx, cmd); err != nil {
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			return "", timeoutError{fmt.Sprintf("timed out after %s and was killed", timeout)}
+		case ctx.Err() != nil:
+			return "", fmt.Errorf("interrupted")
 		}
-		return "", fmt.Errorf(" » failed to execute command substitution for variable '%s' on line %d in '%s': %w", key, lineNum, envFilePath, err)
+		return "", err
 	}
-	return strings.TrimSuffix(string(output), "\n"), nil
+	return strings.TrimSuffix(output.String(), "\n"), nil
 }
 
 // usage prints detailed usage information to stderr and exits the program
 // with a non-zero status, indicating an error or invalid invocation.
 func usage() {
-	fmt.Fprintf(os.Stderr, `Usage: setnv <id>[,<id2>,...] [<executable> [<args...>]]
-       setnv <id>[,<id2>,...] --view  (to display variables read from the file(s) and EXIT)
-       eval "$(setnv <id>[,<id2>,...] --export)" (to load environment into the current shell)
+	fmt.Fprintf(os.Stderr, `Usage: setnv <command> [options] <id>[,<id2>,...] [<args...>]
+
+Commands (see 'setnv <command> --help'):
+       setnv run <ids> [--] <executable> [<args...>]  (to run an executable with the variables)
+       setnv shell <ids>                  (to launch a subshell with the variables)
+       eval "$(setnv export <ids>)"       (to load environment into the current shell)
+       setnv view <ids> [--reveal] [--provenance]  (to display variables read from the file(s) and EXIT)
+       setnv list [--long]                (to list the available IDs)
+       setnv check <ids>                  (to check .env files without running any command)
+       setnv which <ids>                  (to show which .env file each ID refers to)
+       setnv explain <ids> [<KEY>...]     (to show where variables are defined)
+       setnv diff <ids> <ids>             (to show what changes from one environment to another)
+       setnv diff <ids> --against-env     (to show what changes from the current environment)
+       setnv edit <id> [-r <recipient>]...     (to edit <id>.env, or edit and re-encrypt <id>.env.age)
+       setnv encrypt <id> [-r <recipient>]...  (to encrypt <id>.env to <id>.env.age)
+       setnv cache clear  (to remove every cached substitution result)
        setnv --version    (to display version information)
        setnv --help       (to display this help message)
 
+The positional syntax still works:
+       setnv [options] <id>[,<id2>,...] [options] [--] [<executable> [<args...>]]
+       setnv <id>[,<id2>,...] --view [--reveal]
+       eval "$(setnv <id>[,<id2>,...] --export)"
+An ID named like a command, e.g. 'list' for list.env, is loaded with
+'setnv -- list [<executable> [<args...>]]' or 'setnv run list -- <executable>'.
+
 Description:
   Loads environment variables from one or more .env files, specified by comma-separated IDs.
   Files are processed in order, with later files overriding variables from earlier ones.
   setnv looks for <id>.env in the current directory, or if not found,
   from ~/.config/setnv/<id>.env (or the path in SETNV_CONFIG_DIR).
+  If no <id>.env exists in a location, an age-encrypted <id>.env.age is used instead.
   Supports variable expansion (e.g., FOO=$BAR or FOO=${BAR}) and command substitution.
   For command substitution, both $(...) and $[...] syntaxes are available.
   The $[...] syntax is recommended for commands that include parentheses or backticks.
+  Secrets can be referenced as ${secret:<scheme>:<path>} (schemes: gopass, pass, file, vault).
 
 Options:
+  Options may be given before and after the IDs. The executable starts at the
+  first argument after the IDs, or after '--'; all arguments from there on are
+  passed to it.
   --sandboxed       If set, the executed command will receive an environment
                     composed *only* of variables defined in the .env files,
                     disregarding any inherited environment variables not
                     explicitly overridden. By default, inherited variables
                     are included and overridden by .env file definitions.
                     Example: setnv myproject --sandboxed bash -c export
+  -e KEY=VALUE      Set KEY for this invocation only, after all .env files, with
+                    the same expansion and substitution as a .env line.
+                    Repeatable. Example: setnv prod -e LOG_LEVEL=debug ./server
+  --env-file <path> Also load the .env file at <path> after those of the IDs,
+                    and before any -e overrides. Repeatable.
+                    Example: setnv prod --env-file ./local.env ./server
+  --trace           Log on stderr every path considered for each ID, whether it
+                    was used, not found, or shadowed, and the final file order.
+                    Example: setnv dev --trace --view
+  --cmd-timeout <d> Kill any command substitution or secret lookup still running
+                    after the duration <d> (e.g. 10s), together with all of
+                    its child processes. '# @timeout <d>' above an entry
+                    overrides it for that entry ('0' disables it).
+                    Ctrl-C stops all running substitutions.
+                    Example: setnv prod --cmd-timeout 15s
+  --retry <n>       Run a failed command substitution or secret lookup up to
+                    <n> more times, waiting --retry-backoff (default: 500ms)
+                    before the first retry and twice as long before each
+                    following one.
+                    '# @retry <n> backoff=<d>' above an entry overrides both.
+                    Example: setnv prod --retry 2 --retry-backoff 1s
+  --jobs <n>        Run up to <n> command substitutions and secret lookups at
+                    the same time (default: 1, strictly in file order). A
+                    substitution then only sees the variables it references
+                    and earlier variables without substitutions. Values and
+                    warnings are still reported in file order.
+                    Example: setnv prod --jobs 8 --view
+  --no-cache        Ignore '# @cache <ttl>' directives: run every substitution
+                    and neither read nor update the secret cache.
+                    Example: setnv prod --no-cache --view
+  --as-files <keys> Deliver the comma-separated variables <keys> to the executable
+                    as files instead, like 'KEY=@file:...' entries: each value is
+                    written to a file readable only by you (on tmpfs if available),
+                    and the executable gets KEY_FILE=<path> instead of KEY. The
+                    files are removed when it exits.
+                    Example: setnv prod --as-files DB_PASS,API_KEY ./server
+  --supervise       Run the executable (or subshell) as a subprocess instead of
+                    replacing setnv with it. setnv forwards signals to it, reports
+                    its exit status on stderr, cleans up after it (e.g., secret
+                    files), and exits with the same status.
+                    Example: setnv prod --supervise ./server
+  --watch           Supervise the executable and restart it whenever the .env
+                    files, or files read by ${secret:file:...}, change. Changes
+                    are debounced, the executable gets SIGTERM and, after 5s,
+                    SIGKILL, and the changed variable names are reported.
+                    Example: setnv dev --watch go run .
+  --procfile <path> Run every process of a Procfile ('<name>: <command>' lines)
+                    under the environment, resolved once. Their output is
+                    prefixed with the process name, Ctrl-C or SIGTERM stops them
+                    all, and when one exits the others are stopped.
+                    Example: setnv dev --procfile Procfile
+  --keep-going      With --procfile, keep the other processes running when one
+                    exits.
+
+Secret Cache:
+  '# @cache <ttl>' above an entry caches the output of its command substitutions
+  and secret lookups on disk for <ttl> (e.g. 8h), encrypted to the local age
+  identity, in $SETNV_CACHE_DIR or ~/.cache/setnv. Cache hits and misses are
+  reported on stderr. 'setnv cache clear' removes every cached result.
+
+Encrypted Environment Files:
+  <id>.env.age files are decrypted in memory with the age identity in
+  SETNV_AGE_IDENTITY (a file path or an AGE-SECRET-KEY-... value) or
+  ~/.config/setnv/identity. 'setnv encrypt' and 'setnv edit' encrypt to every
+  recipient in ~/.config/setnv/recipients, each -r <recipient>, and the local identity.
+  Example: setnv encrypt prod -r age1...
+  Dotenv files encrypted by SOPS with age are detected and decrypted in-process,
+  using the identity above or SOPS_AGE_KEY, SOPS_AGE_KEY_FILE, or
+  ~/.config/sops/age/keys.txt. The sops binary is not required.
 
 Modes of Operation:
   1. setnv <id>[,<id2>,...] <executable> [args...]
@@ -173,9 +423,11 @@ Modes of Operation:
      Variables WILL persist. Use with caution for sensitive data (visible via 'ps e').
      Example: eval "$(setnv common,prod --export)"
 
-  4. setnv <id>[,<id2>,...] --view
-     Displays the resolved variables (including secrets from command substitutions) that would be loaded.
-     WARNING: This will print plaintext secrets to your terminal. Use with caution.
+  4. setnv <id>[,<id2>,...] --view [--fingerprint] [--reveal]
+     Displays the resolved variables that would be loaded. Values derived from command
+     substitutions or secret references, directly or via $VAR, are masked as '****'.
+     --fingerprint appends a short hash (e.g. 'hmac:1a2b3c4d') to tell masked values apart.
+     --reveal prints them in plaintext instead. Use with caution.
      This mode does NOT launch a shell or run an executable; it only displays.
      Example: setnv local_dev_secrets --view
 
@@ -183,9 +435,18 @@ Environment File Format:
   (Looked for in current directory first, then in ~/.config/setnv/)
   KEY=VALUE
   # Comments are supported
+  # @pre-exec $[./scripts/check-vpn.sh]            # Runs before the executable; if it fails, the executable is not started
+  # @post-exec $[echo "exited: $SETNV_EXIT_STATUS"] # Runs after the executable exits (setnv then supervises it)
   DB_PASS=$(gopass show myproject/database/password) # Special command substitution: supports 'gopass show <path>' or 'gopass <path>'
+  DB_USER=$(gopass show myproject/database username) # Flags and a key are passed through to 'gopass show'
   MY_SECRET=$(some_simple_cmd)                       # Generic command substitution with $() syntax (use with caution for complex commands)
   API_KEY=$[retrieve-api-key.sh --key=abc]           # Robust command substitution using $[] syntax (recommended for complexity)
+  DB_TOKEN=${secret:gopass:myproject/database/token} # Secret provider reference (<scheme>:<path>)
+  DB_URL=${secret:gopass:myproject/database#url}     # Field of a gopass entry (<scheme>:<path>#<field>)
+  SITE_USER=${secret:pass:web/site#username}        # pass: first line by default, or a named field
+  TLS_KEY=${secret:file:/run/secrets/tls_key}        # Reads the secret from a file
+  PGPASSWORD=@file:$(gopass show db/password)        # Delivered as PGPASSWORD_FILE=<path to a private file>
+  DB_PASSWORD=${secret:vault:kv/data/app#password}   # Vault KV v1/v2 over HTTP (VAULT_ADDR, VAULT_TOKEN, VAULT_NAMESPACE)
   # Example of $[] handling internal parentheses/backticks:
   # COMPLEX_CMD=$[echo "Current time is $(date) (GMT)"]
   APP_PORT=8080
@@ -216,121 +477,246 @@ func expandVarsInString(text string, combinedEnvForLookup map[string]string) str
 	})
 }
 
+// openEnvFile opens the .env file at envFilePath for reading. Age-encrypted
+// `.env.age` files are decrypted in memory first, and SOPS-encrypted dotenv
+// files have their values decrypted, so the caller always reads plaintext.
+func openEnvFile(envFilePath string) (io.ReadCloser, error) {
+	var content []byte
+	var err error
+	if strings.HasSuffix(envFilePath, ageFileSuffix) {
+		content, err = decryptAgeFile(envFilePath)
+	} else {
+		content, err = os.ReadFile(envFilePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if isSopsDotenv(content) {
+		if content, err = decryptSopsDotenv(content); err != nil {
+			return nil, fmt.Errorf("could not decrypt SOPS file '%s': %w", envFilePath, err)
+		}
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
 // parseEnvFile reads the .env file at the given path, processes each line
 // for key-value pairs, handles command substitutions, unquotes values,
 // and finally performs variable expansion. It returns a map of the fully
 // resolved environment variables that were *defined in the .env file*.
 func parseEnvFile(envFilePath string, cmdExecutor commandExecutor, inheritedEnvMap map[string]string) (map[string]string, error) {
-	file, err := os.Open(envFilePath)
+	return newResolver(cmdExecutor).parseEnvFile(envFilePath, inheritedEnvMap)
+}
+
+// parseEnvFile is the resolver's implementation of the package-level parseEnvFile.
+// Resolving chained files with the same resolver shares memoized substitutions.
+func (r *resolver) parseEnvFile(envFilePath string, inheritedEnvMap map[string]string) (map[string]string, error) {
+	lines, err := readEnvFileLines(envFilePath)
+	if err != nil {
+		return nil, fmt.Errorf(" » %w", err)
+	}
+	return r.parseEnvLines(lines, envFilePath, inheritedEnvMap)
+}
+
+// readEnvFileLines returns the lines of the .env file at envFilePath, decrypted
+// if needed (see openEnvFile).
+func readEnvFileLines(envFilePath string) ([]string, error) {
+	file, err := openEnvFile(envFilePath)
 	if err != nil {
-		return nil, fmt.Errorf(" » could not open .env file '%s': %w", envFilePath, err)
+		return nil, fmt.Errorf("could not open .env file '%s': %w", envFilePath, err)
 	}
 	defer file.Close() // Ensure the file is closed when the function exits.
 
-	initialEnvMap := make(map[string]string) // Stores only fully resolved values.
+	var lines []string
 	scanner := bufio.NewScanner(file)
-	lineNum := 0
-
 	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text()) // Read and trim whitespace from the line.
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading .env file '%s': %w", envFilePath, err)
+	}
+	return lines, nil
+}
 
-		// Skip empty lines and lines that are comments (start with '#').
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
+// parseEnvLines resolves the lines of a .env file like parseEnvFile. envFilePath
+// names their source in messages.
+func (r *resolver) parseEnvLines(lines []string, envFilePath string, inheritedEnvMap map[string]string) (map[string]string, error) {
+	r.pendingSecretRefs = batchableSecretRefs(lines)
+	r.markRedefinitions(lines, envFilePath, inheritedEnvMap)
+	preExecHooks, postExecHooks := execHooksIn(lines, envFilePath)
+	r.preExecHooks = append(r.preExecHooks, preExecHooks...)
+	r.postExecHooks = append(r.postExecHooks, postExecHooks...)
+	if r.jobs > 1 {
+		resolvedEnvMap := r.resolveEntriesConcurrently(lines, envFilePath, inheritedEnvMap)
+		if r.ctx.Err() != nil {
+			return nil, fmt.Errorf(" » resolving '%s' was interrupted", envFilePath)
 		}
+		return resolvedEnvMap, nil
+	}
 
-		// Split the line into a key and a value at the first '=' sign.
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			// If a line doesn't contain an '=', it's considered malformed.
-			// Print a warning to stderr and skip this line.
-			fmt.Fprintf(os.Stderr, " » setnv: Warning: Skipping malformed line %d in '%s': '%s'. Expected 'KEY=VALUE' format.\n", lineNum, envFilePath, line)
+	diag := r.redactor.writer(os.Stderr)
+	defer diag.Flush()
+	initialEnvMap := make(map[string]string) // Stores only fully resolved values.
+	var directives entryOptions              // Collected from directive comments for the next entry.
+	for i, line := range lines {
+		if r.ctx.Err() != nil {
+			break
+		}
+		entry, ok := parseEnvLine(line, i+1, envFilePath, &directives, diag)
+		if !ok {
 			continue
 		}
+		r.markSensitive(entry)
+		r.asFile[entry.key] = entry.opts.asFile
+		// Store the fully processed (expanded and substituted) key-value pair.
+		// initialEnvMap now directly holds the resolved values.
+		initialEnvMap[entry.key] = r.resolveEntry(entry, envFilePath, inheritedEnvMap, initialEnvMap, diag)
+	}
+	if r.ctx.Err() != nil {
+		return nil, fmt.Errorf(" » resolving '%s' was interrupted", envFilePath)
+	}
 
-		// Ensure no leading or trailing spaces
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-
-		// Handle quoted values:
-		// Double-quoted strings support escape sequences (processed by strconv.Unquote).
-		if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
-			unquotedValue, err := strconv.Unquote(value)
-			if err == nil {
-				value = unquotedValue // If unquoting is successful, use the unquoted value.
-			} else {
-				// If unquoting fails (e.g., malformed escape, unclosed quote),
-				// log a warning and fall back to simply stripping the outer quotes.
-				fmt.Fprintf(os.Stderr, " » setnv: Warning: Could not fully unquote value '%s' on line %d in '%s'. Error: %v. Using value after simple outer quote stripping.\n", value, lineNum, envFilePath, err)
-				value = value[1 : len(value)-1] // Strip outer quotes manually.
-			}
-		} else if strings.HasPrefix(value, `'`) && strings.HasSuffix(value, `'`) && len(value) >= 2 {
-			// Single-quoted strings are treated literally; only strip outer quotes.
-			// No inner escape sequence processing (e.g., '\' remains '\' inside single quotes).
-			value = value[1 : len(value)-1]
-		}
-
-		// Handle literal dollar signs: Replace escaped "\$" with literalDollarPlaceholder
-		// This must happen after unquoting, but before command and variable expansion,
-		// so that `\$` is not misinterpreted as a variable.
-		value = strings.ReplaceAll(value, `\$`, literalDollarPlaceholder)
-
-		// Prepare the combined environment map for lookup during *this line's* processing.
-		// It includes inherited variables and variables from previously processed lines.
-		combinedEnvForLookup := mergeMaps(inheritedEnvMap, initialEnvMap)
-
-		// --- Process Value: Aligned with logic.py's process_value function ---
-
-		// 1. Variable Expansion Pass
-		// This replaces `$VAR` or `${VAR}` with their values from combinedEnvForLookup.
-		value = expandVarsInString(value, combinedEnvForLookup)
-		// No inner loop needed here, as we established (initialEnvMap already has fully resolved values from prior lines)
-		// and this ReplaceAllStringFunc will resolve all immediate $VARs.
-
-		// 2. Gopass Command Substitution Pass
-		// Replaces `$(gopass show <path>)` with its output.
-		value = gopassRegex.ReplaceAllStringFunc(value, func(matchStr string) string {
-			matches := gopassRegex.FindStringSubmatch(matchStr)
-			if len(matches) < 2 { // Should not happen if regex matched
-				return matchStr // Return original if path not captured
-			}
-			gopassPath := matches[1]
-			commandToExecute := fmt.Sprintf("gopass show --password %s", gopassPath)
+	// At this point, initialEnvMap contains all fully resolved values from the .env file.
+	return initialEnvMap, nil
+}
 
-			output, err := executeCommandSubstitution(key, commandToExecute, envFilePath, lineNum, cmdExecutor, inheritedEnvMap, initialEnvMap)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, " » setnv: Warning: %v.\n", err)
-				fmt.Fprintln(os.Stderr, " » This usually means the gopass secret does not exist or gopass encountered an error. Value set to empty.")
-				return ""
-			}
+// parseEnvLine splits a .env line into its key and unquoted value. It reports
+// false for empty lines and comments, and warns about malformed lines on diag.
+// Directive comments are collected in directives, which are then attached to,
+// and cleared by, the next entry.
+func parseEnvLine(rawLine string, lineNum int, envFilePath string, directives *entryOptions, diag io.Writer) (envEntry, bool) {
+	line := strings.TrimSpace(rawLine) // Trim whitespace from the line.
 
-			// Crucially: Expand variables *within the command's output*
-			output = expandVarsInString(output, combinedEnvForLookup)
+	// Skip empty lines and lines that are comments (start with '#').
+	if len(line) == 0 {
+		return envEntry{}, false
+	}
+	if strings.HasPrefix(line, "#") {
+		if _, err := parseDirective(line[1:], directives); err != nil {
+			fmt.Fprintf(diag, " » setnv: Warning: Ignoring directive on line %d in '%s': %v.\n", lineNum, envFilePath, err)
+		}
+		return envEntry{}, false
+	}
 
-			if output == "" {
-				fmt.Fprintf(os.Stderr, " » setnv: Warning: gopass command for variable '%s' (path: '%s') returned an empty value on line %d in '%s'.\n", key, gopassPath, lineNum, envFilePath)
-			}
-			return output
-		})
+	// Split the line into a key and a value at the first '=' sign.
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		// If a line doesn't contain an '=', it's considered malformed.
+		// Print a warning to stderr and skip this line.
+		fmt.Fprintf(diag, " » setnv: Warning: Skipping malformed line %d in '%s': '%s'. Expected 'KEY=VALUE' format.\n", lineNum, envFilePath, line)
+		return envEntry{}, false
+	}
 
-		// 3. Generic Command Substitution Pass
-		// Replaces `$[command args...]` with its output.
-		value = applyCommandSubstitution(value, alternateCommandRegex, key, envFilePath, lineNum, cmdExecutor, inheritedEnvMap, initialEnvMap, combinedEnvForLookup)
-		// Replaces `$(command args...)` with its output.
-		value = applyCommandSubstitution(value, genericCommandRegex, key, envFilePath, lineNum, cmdExecutor, inheritedEnvMap, initialEnvMap, combinedEnvForLookup)
+	// Ensure no leading or trailing spaces
+	key := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
 
-		// Store the fully processed (expanded and substituted) key-value pair.
-		// initialEnvMap now directly holds the resolved values.
-		initialEnvMap[key] = value
+	// Handle quoted values:
+	// Double-quoted strings support escape sequences (processed by strconv.Unquote).
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) && len(value) >= 2 {
+		unquotedValue, err := strconv.Unquote(value)
+		if err == nil {
+			value = unquotedValue // If unquoting is successful, use the unquoted value.
+		} else {
+			// If unquoting fails (e.g., malformed escape, unclosed quote),
+			// log a warning and fall back to simply stripping the outer quotes.
+			// The value is not printed: it may be a literal secret.
+			fmt.Fprintf(diag, " » setnv: Warning: Could not fully unquote the value of '%s' on line %d in '%s'. Error: %v. Using value after simple outer quote stripping.\n", key, lineNum, envFilePath, err)
+			value = value[1 : len(value)-1] // Strip outer quotes manually.
+		}
+	} else if strings.HasPrefix(value, `'`) && strings.HasSuffix(value, `'`) && len(value) >= 2 {
+		// Single-quoted strings are treated literally; only strip outer quotes.
+		// No inner escape sequence processing (e.g., '\' remains '\' inside single quotes).
+		value = value[1 : len(value)-1]
 	}
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf(" » error reading .env file '%s': %w", envFilePath, err)
+	// `KEY=@file:VALUE` delivers VALUE to the executable as a file.
+	opts := *directives
+	if rest, ok := strings.CutPrefix(value, secretFilePrefix); ok {
+		value, opts.asFile = rest, true
 	}
 
-	// At this point, initialEnvMap contains all fully resolved values from the .env file.
-	return initialEnvMap, nil
+	// Handle literal dollar signs: Replace escaped "\$" with literalDollarPlaceholder
+	// This must happen after unquoting, but before command and variable expansion,
+	// so that `\$` is not misinterpreted as a variable.
+	value = strings.ReplaceAll(value, `\$`, literalDollarPlaceholder)
+
+	entry := envEntry{key: key, value: value, lineNum: lineNum, opts: opts}
+	*directives = entryOptions{}
+	return entry, true
+}
+
+// resolveEntry expands and substitutes the value of entry. initialEnvMap holds
+// the resolved variables of the current file that the entry may see.
+func (r *resolver) resolveEntry(entry envEntry, envFilePath string, inheritedEnvMap map[string]string, initialEnvMap map[string]string, diag io.Writer) string {
+	key, value, lineNum := entry.key, entry.value, entry.lineNum
+
+	// Prepare the combined environment map for lookup during *this line's* processing.
+	// It includes inherited variables and variables from previously processed lines.
+	combinedEnvForLookup := mergeMaps(inheritedEnvMap, initialEnvMap)
+
+	// --- Process Value: Aligned with logic.py's process_value function ---
+
+	// 1. Variable Expansion Pass
+	// This replaces `$VAR` or `${VAR}` with their values from combinedEnvForLookup.
+	value = expandVarsInString(value, combinedEnvForLookup)
+	// No inner loop needed here, as we established (initialEnvMap already has fully resolved values from prior lines)
+	// and this ReplaceAllStringFunc will resolve all immediate $VARs.
+
+	// 2. Secret Provider Pass
+	// Replaces `${secret:<scheme>:<path>}` with the value returned by the registered provider.
+	value = r.applySecretReferences(value, key, envFilePath, lineNum, entry.opts, inheritedEnvMap, initialEnvMap, diag)
+
+	// 3. Gopass Command Substitution Pass
+	// Replaces `$(gopass show [flags] <path> [key])` with its output.
+	value = gopassRegex.ReplaceAllStringFunc(value, func(matchStr string) string {
+		matches := gopassRegex.FindStringSubmatch(matchStr)
+		if len(matches) < 3 { // Should not happen if regex matched
+			return matchStr // Return original if path not captured
+		}
+		gopassFlags := strings.Fields(matches[1])
+		pathAndKey := strings.Fields(matches[2])
+		if len(pathAndKey) == 0 { // e.g., `$(gopass show )`
+			return matchStr
+		}
+		gopassPath, gopassKey := pathAndKey[0], strings.Join(pathAndKey[1:], " ")
+		commandToExecute := "gopass " + strings.Join(gopassShowArgs(gopassFlags, gopassPath, gopassKey), " ")
+
+		output, err := r.executeCommandSubstitution(key, commandToExecute, envFilePath, lineNum, entry.opts, inheritedEnvMap, initialEnvMap, diag)
+		if err != nil {
+			fmt.Fprintf(diag, " » setnv: Warning: %v.\n", err)
+			fmt.Fprintf(diag, " » This usually means the gopass secret does not exist or gopass encountered an error. Value set to empty.\n")
+			return ""
+		}
+
+		// Crucially: Expand variables *within the command's output*
+		output = expandVarsInString(output, combinedEnvForLookup)
+
+		if output == "" {
+			fmt.Fprintf(diag, " » setnv: Warning: gopass command for variable '%s' (path: '%s') returned an empty value on line %d in '%s'.\n", key, gopassPath, lineNum, envFilePath)
+		}
+		return output
+	})
+
+	// 4. Generic Command Substitution Pass
+	// Replaces `$[command args...]` with its output.
+	value = r.applyCommandSubstitution(value, alternateCommandRegex, key, envFilePath, lineNum, entry.opts, inheritedEnvMap, initialEnvMap, combinedEnvForLookup, diag)
+	// Replaces `$(command args...)` with its output.
+	value = r.applyCommandSubstitution(value, genericCommandRegex, key, envFilePath, lineNum, entry.opts, inheritedEnvMap, initialEnvMap, combinedEnvForLookup, diag)
+
+	return value
+}
+
+// environMap returns the environment of the setnv process as a map.
+func environMap() map[string]string {
+	envMap := make(map[string]string)
+	for _, envVar := range os.Environ() {
+		parts := strings.SplitN(envVar, "=", 2)
+		if len(parts) == 2 {
+			envMap[parts[0]] = parts[1]
+		}
+	}
+	return envMap
 }
 
 // mapToSlice converts a map[string]string to a slice of strings in "KEY=VALUE" format.
@@ -365,75 +751,245 @@ func mergeMaps(maps ...map[string]string) map[string]string {
 	return merged
 }
 
+// resolvedEnv is the outcome of resolving the .env files with a resolver.
+type resolvedEnv struct {
+	vars     map[string]string // The joint variables, later files overriding earlier ones.
+	fileKeys []string          // The variables to deliver as files (see writeSecretFiles).
+	paths    []string          // The files the variables were resolved from (see watchedPaths).
+
+	preExecHooks  []execHook // Run before the executable is started.
+	postExecHooks []execHook // Run after the executable exits.
+}
+
+// envOverridesSource names the `-e KEY=VALUE` overrides in messages, in place
+// of a .env file.
+const envOverridesSource = "-e"
+
+// resolveEnvFiles resolves the chained .env files at envFilePaths with r, on
+// top of osEnvMap, and then the `-e KEY=VALUE` overrides as if they were the
+// lines of a final file. It returns the joint variables they define. Later
+// files override earlier ones.
+func resolveEnvFiles(r *resolver, envFilePaths []string, overrides []string, osEnvMap map[string]string) (map[string]string, error) {
+	jointResolvedEnvMap := make(map[string]string)
+	inheritedEnvMap := osEnvMap
+	for i := 0; i <= len(envFilePaths); i++ {
+		var resolvedEnvMap map[string]string
+		var err error
+		if i < len(envFilePaths) {
+			// `parseEnvFile` returns a `map[string]string` containing the fully resolved variables.
+			resolvedEnvMap, err = r.parseEnvFile(envFilePaths[i], inheritedEnvMap)
+		} else if len(overrides) > 0 {
+			resolvedEnvMap, err = r.parseEnvLines(overrides, envOverridesSource, inheritedEnvMap)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Merge the resolved variables from the current .env file into the joint map.
+		// Later files override earlier ones.
+		jointResolvedEnvMap = mergeMaps(jointResolvedEnvMap, resolvedEnvMap)
+
+		// For processing the *next* .env file in the chain, the `inheritedEnvMap`
+		// should be the combination of `osEnvMap` and all files processed so far.
+		inheritedEnvMap = mergeMaps(osEnvMap, jointResolvedEnvMap)
+	}
+
+	// Final pass to replace the placeholder for literal dollar signs ($) that were escaped.
+	for k, v := range jointResolvedEnvMap {
+		jointResolvedEnvMap[k] = strings.ReplaceAll(v, literalDollarPlaceholder, `$`)
+	}
+	return jointResolvedEnvMap, nil
+}
+
+// configDir returns the centralized directory for .env files: SETNV_CONFIG_DIR
+// if set, otherwise DefaultConfigDir under the user's home directory.
+func configDir() (string, error) {
+	if dir := os.Getenv("SETNV_CONFIG_DIR"); dir != "" {
+		return dir, nil
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Could not determine user home directory: %v", err)
+	}
+	return filepath.Join(homeDir, DefaultConfigDir), nil
+}
+
+// envFileNames returns the file names that may hold the variables for envID,
+// in order of preference: the plain `<id>.env`, then the age-encrypted `<id>.env.age`.
+func envFileNames(envID string) []string {
+	return []string{envID + ".env", envID + ".env" + ageFileSuffix}
+}
+
+// findEnvFile locates the .env file for envID. The current directory is
+// searched first, then the configuration directory (see configDir).
+func findEnvFile(envID string) (string, error) {
+	return traceEnvFile(envID, nil)
+}
+
+// findChainedEnvFiles locates the .env file of each of the comma-separated
+// ids, in order (see findEnvFile).
+func findChainedEnvFiles(ids string) ([]string, error) {
+	var envFilePaths []string
+	for _, envID := range strings.Split(ids, ",") {
+		if envID = strings.TrimSpace(envID); envID == "" {
+			continue
+		}
+		envFilePath, err := findEnvFile(envID)
+		if err != nil {
+			return nil, err
+		}
+		envFilePaths = append(envFilePaths, envFilePath)
+	}
+	if len(envFilePaths) == 0 {
+		return nil, fmt.Errorf("no .env file IDs provided")
+	}
+	return envFilePaths, nil
+}
+
+// traceEnvFile is findEnvFile, reporting each path it considers to trace, if
+// not nil, with the decision made about it. When tracing, the paths after the
+// one found are checked too, and reported as shadowed if they exist.
+func traceEnvFile(envID string, trace func(path, decision string)) (string, error) {
+	names := envFileNames(envID)
+	var found string
+	// consider checks whether path exists, unless a file was found already
+	// and nothing is traced.
+	consider := func(path string) error {
+		if found != "" && trace == nil {
+			return nil
+		}
+		_, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		decision := "not found"
+		if err == nil && found == "" {
+			found, decision = path, "found, using it"
+		} else if err == nil {
+			decision = fmt.Sprintf("found, but shadowed by '%s'", absPath(found))
+		}
+		if trace != nil {
+			trace(path, decision)
+		}
+		return nil
+	}
+
+	// 1. Try to find the .env file in the current directory first.
+	for _, name := range names {
+		if err := consider(name); err != nil {
+			// An error other than "not exist" occurred when checking the current directory.
+			return "", fmt.Errorf("Could not access environment file '%s' in current directory: %v", name, err)
+		}
+	}
+
+	// 2. If not found in the current directory, then check the configured directory.
+	if found != "" && trace == nil {
+		return found, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		if found != "" {
+			return found, nil
+		}
+		return "", err
+	}
+	for _, name := range names {
+		envFilePath := filepath.Join(dir, name)
+		if err := consider(envFilePath); err != nil {
+			return "", fmt.Errorf("Could not access environment file '%s': %v", envFilePath, err)
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("Environment file '%s' not found in current directory or '%s'", names[0], dir)
+	}
+	return found, nil
+}
+
+// newEnvResolver returns a resolver configured by the command-line options.
+// One resolver is shared by all files, so that substitutions are memoized
+// across them; --watch uses a new one for every resolution.
+func newEnvResolver(ctx context.Context, opts *options) *resolver {
+	envResolver := newResolver(defaultCommandExecutor)
+	envResolver.ctx = ctx
+	envResolver.cmdTimeout = opts.cmdTimeout
+	envResolver.retries, envResolver.retryBackoff = opts.retries, opts.retryBackoff
+	envResolver.setJobs(opts.jobs)
+	if !opts.noCache {
+		dir, err := cacheDir()
+		envResolver.cache = newSecretCache(dir)
+		envResolver.cache.err = err // Reported by entries with `# @cache`.
+	}
+	return envResolver
+}
+
 func main() {
 	args := os.Args[1:] // Get command-line arguments, excluding the program name itself.
 
 	var (
-		sandBoxed  bool     // Flag for `--sandboxed` mode.
-		viewMode   bool     // Flag for `--view` mode.
-		exportMode bool     // Flag for `--export` mode.
 		executable string   // The executable to run in default mode.
 		execArgs   []string // Arguments for the executable.
 	)
 
-	// --- Parse Command-Line Flags ---
-	// Check for global flags like `--version`, `--help`, `--view`, `--export` at the start of args.
-	if len(args) > 0 {
-		switch args[0] {
-		case "--version":
-			fmt.Printf("setnv version %s\n", version)
-			os.Exit(0) // Exit after printing version.
-		case "--help":
-			usage() // Print usage and exit.
-		case "--view":
-			viewMode = true
-			if len(args) > 1 { // If ID is provided after --view
-				args = []string{args[1]}
-			} else { // If only --view is provided without ID
-				usage() // ID is mandatory
-			}
-		case "--export":
-			exportMode = true
-			if len(args) > 1 { // If ID is provided after --export
-				args = []string{args[1]}
-			} else { // If only --export is provided without ID
-				usage() // ID is mandatory
-			}
-		case "--sandboxed":
-			sandBoxed = true
-			args = args[1:]
-		default:
-			// Handle cases where flags might appear after the ID (e.g., setnv myid --view)
-			if len(args) > 1 {
-				switch args[1] {
-				case "--view":
-					viewMode = true
-					args = []string{args[0]} // Keep only the ID
-				case "--export":
-					exportMode = true
-					args = []string{args[0]} // Keep only the ID
-				case "--sandboxed":
-					sandBoxed = true
-					if len(args) > 2 { // setnv ID --sandboxed executable args
-						args = append(args[:1], args[2:]...) // Remove --sandboxed, keep ID and subsequent args
-					} else { // setnv ID --sandboxed
-						args = args[:1] // Keep only ID
-					}
-				}
+	// --- Handle Subcommands ---
+	// `list`, `check`, `diff`, `edit`, and the like do not resolve an
+	// environment for an executable, and exit here. `run`, `shell`, `export`,
+	// and `view` are handled by parseArgs.
+	if len(args) > 0 && subcommands[args[0]].run != nil {
+		warnShadowedEnvFile(args[0])
+		cmd := subcommands[args[0]]
+		for _, arg := range args[1:] {
+			if arg == "--help" || arg == "-h" {
+				fmt.Fprint(os.Stderr, cmd.usage)
+				os.Exit(0)
 			}
 		}
+		if err := cmd.run(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// --- Validate Remaining Arguments ---
-	if len(args) == 0 {
-		// If no ID is provided after flag parsing, display usage and exit.
-		usage()
+	// --- Parse Command-Line Flags ---
+	opts, err := parseArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " » setnv: Error: %v.\n » setnv: Run 'setnv --help' for usage.\n", err)
+		os.Exit(1)
+	}
+	if opts.version {
+		fmt.Printf("setnv version %s\n", version)
+		os.Exit(0) // Exit after printing version.
+	}
+	if opts.subcommand != "" && (opts.help || opts.ids == "") {
+		if opts.ids == "" {
+			warnShadowedEnvFile(opts.subcommand) // `setnv view` used to load view.env.
+		}
+		fmt.Fprint(os.Stderr, subcommands[opts.subcommand].usage)
+		if opts.help {
+			os.Exit(0)
+		}
+		os.Exit(1) // An ID is mandatory.
+	}
+	if opts.help || opts.ids == "" {
+		// An ID is mandatory.
+		usage() // Print usage and exit.
+	}
+	var procfileEntries []procfileEntry
+	if opts.procfile != "" {
+		file, err := os.Open(opts.procfile)
+		if err == nil {
+			procfileEntries, err = parseProcfile(file)
+			file.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error reading Procfile '%s': %v\n", opts.procfile, err)
+			os.Exit(1)
+		}
 	}
 
-	idsStr := args[0] // The first remaining argument is always the ID for the .env file.
-	if len(args) > 1 {
-		executable = args[1] // The second argument (if present) is the executable.
-		execArgs = args[1:]  // All arguments from the executable onwards are its arguments.
+	idsStr := opts.ids
+	if len(opts.command) > 0 {
+		executable = opts.command[0] // The first argument of the command is the executable.
+		execArgs = opts.command      // All arguments from the executable onwards are its arguments.
 	}
 
 	// Split the comma-delimited IDs
@@ -443,7 +999,6 @@ func main() {
 		os.Exit(1)
 	}
 
-	var envFilePath string
 	var envFilePaths []string
 
 	for _, envID := range envIDs {
@@ -452,95 +1007,103 @@ func main() {
 			continue // Skip empty parts if user provides "id1,,id2"
 		}
 
-		localEnvFileName := envID + ".env"
-
-		// 1. Try to find the .env file in the current directory first.
-		if _, err := os.Stat(localEnvFileName); err == nil {
-			envFilePath = localEnvFileName
-		} else if os.IsNotExist(err) {
-			// 2. If not found in the current directory, then check the configured directory.
-			configDir := os.Getenv("SETNV_CONFIG_DIR")
-			if configDir == "" {
-				homeDir, err := os.UserHomeDir()
-				if err != nil {
-					fmt.Fprintf(os.Stderr, " » setnv: Error: Could not determine user home directory: %v\n", err)
-					os.Exit(1)
-				}
-				configDir = filepath.Join(homeDir, DefaultConfigDir)
+		// `--trace` logs every path considered for the ID, and the decision about it.
+		var trace func(path, decision string)
+		if opts.trace {
+			trace = func(path, decision string) {
+				fmt.Fprintf(os.Stderr, " » setnv: Trace: ID '%s': '%s' %s.\n", envID, absPath(path), decision)
 			}
-			envFilePath = filepath.Join(configDir, localEnvFileName)
-
-			// Check if the file exists in the configured directory.
-			if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, " » setnv: Error: Environment file '%s' not found in current directory or '%s'.\n", localEnvFileName, configDir)
-				os.Exit(1)
-			} else if err != nil {
-				fmt.Fprintf(os.Stderr, " » setnv: Error: Could not access environment file '%s': %v\n", envFilePath, err)
-				os.Exit(1)
-			}
-		} else {
-			// An error other than "not exist" occurred when checking the current directory.
-			fmt.Fprintf(os.Stderr, " » setnv: Error: Could not access environment file '%s' in current directory: %v\n", localEnvFileName, err)
+		}
+		envFilePath, err := traceEnvFile(envID, trace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error: %v.\n", err)
 			os.Exit(1)
 		}
 		envFilePaths = append(envFilePaths, envFilePath)
 	}
-
-	// Initialize the environment map with the current process's environment.
-	osEnvMap := make(map[string]string)
-	for _, envVar := range os.Environ() {
-		parts := strings.SplitN(envVar, "=", 2)
-		if len(parts) == 2 {
-			osEnvMap[parts[0]] = parts[1]
+	envFilePaths = append(envFilePaths, opts.envFiles...)
+	if opts.trace {
+		var absPaths []string
+		for _, envFilePath := range envFilePaths {
+			absPaths = append(absPaths, absPath(envFilePath))
 		}
+		fmt.Fprintf(os.Stderr, " » setnv: Trace: Loading, in order: %s.\n", strings.Join(absPaths, ", "))
 	}
 
-	jointResolvedEnvMap := make(map[string]string)
-	inheritedEnvMap := osEnvMap
+	// Initialize the environment map with the current process's environment.
+	osEnvMap := environMap()
 
-	for _, envFilePath := range envFilePaths {
-		// --- Parse and Resolve Environment Variables (common step for all modes) ---
-		// `parseEnvFile` returns a `map[string]string` containing the fully resolved variables.
-		resolvedEnvMap, err := parseEnvFile(envFilePath, defaultCommandExecutor, inheritedEnvMap)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, " » setnv: Error parsing .env file: %v\n", err)
-			os.Exit(1)
+	// --- Parse and Resolve Environment Variables (common step for all modes) ---
+	// Ctrl-C (or SIGTERM) while resolving stops every running substitution.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	envResolver := newEnvResolver(ctx, opts)
+	jointResolvedEnvMap, err := resolveEnvFiles(envResolver, envFilePaths, opts.envOverrides, osEnvMap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " » setnv: Error parsing .env file: %v\n", err)
+		if ctx.Err() != nil {
+			os.Exit(130) // The conventional exit status after SIGINT.
 		}
-		// Merge the resolved variables from the current .env file into the joint map.
-		// Later files override earlier ones.
-		jointResolvedEnvMap = mergeMaps(jointResolvedEnvMap, resolvedEnvMap)
-
-		// For processing the *next* .env file in the chain, the `inheritedEnvMap`
-		// should be the combination of `osEnvMap` and all files processed so far.
-		inheritedEnvMap = mergeMaps(osEnvMap, jointResolvedEnvMap)
+		os.Exit(1)
 	}
+	stopSignals() // Resolution is done; signals behave normally again.
 
-	// Final pass to replace the placeholder for literal dollar signs ($) that were escaped.
-	for k, v := range jointResolvedEnvMap {
-		jointResolvedEnvMap[k] = strings.ReplaceAll(v, literalDollarPlaceholder, `$`)
+	// Collect the variables to deliver as files: `KEY=@file:...` entries and --as-files.
+	fileKeys, undefinedFileKeys := secretFileKeys(envResolver, jointResolvedEnvMap, opts.asFiles)
+	for _, key := range undefinedFileKeys {
+		fmt.Fprintf(os.Stderr, " » setnv: Warning: --as-files variable '%s' is not defined in the .env file(s).\n", key)
 	}
 
 	// Convert the resolved map back to a slice of "KEY=VALUE" strings.
 	// This format is required for `syscall.Exec` and convenient for `--export` and `--view` modes.
 	jointResolvedEnvVars := mapToSlice(jointResolvedEnvMap)
 
+	// childEnv returns the environment to pass to the executable.
+	childEnv := func(jointResolvedEnvMap map[string]string) map[string]string {
+		if opts.sandboxed {
+			return mergeMaps(jointResolvedEnvMap)
+		}
+		// Prepare the full set of environment variables to pass to the executable
+		return mergeMaps(osEnvMap, jointResolvedEnvMap)
+	}
+
 	// --- Execute based on the determined mode ---
-	if viewMode {
+	if opts.view {
 		// Mode 4: `--view` (Display variables and then EXIT).
+		var origins *provenance
+		if opts.provenance {
+			definitions, err := collectDefinitions(envFilePaths, opts.envOverrides)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, " » setnv: Error: %v\n", err)
+				os.Exit(1)
+			}
+			origins = &provenance{definitions: definitions, inherited: osEnvMap}
+		}
 		for _, varPair := range jointResolvedEnvVars {
 			// Split KEY=VALUE to display in a user-friendly KEY="VALUE" format.
 			parts := strings.SplitN(varPair, "=", 2)
 			if len(parts) == 2 {
+				value := parts[1]
+				if !opts.reveal && envResolver.isSensitive(parts[0]) {
+					value = maskValue(value, opts.fingerprint)
+				}
 				// Use `%q` to properly quote the value for display, similar to bash's `printf %q`.
-				fmt.Printf("%s=%q\n", parts[0], parts[1])
+				if origins != nil {
+					fmt.Printf("%s=%q  # %s\n", parts[0], value, origins.summary(parts[0]))
+				} else {
+					fmt.Printf("%s=%q\n", parts[0], value)
+				}
 			} else {
 				// Fallback for malformed pairs, though `mapToSlice` should prevent this.
 				fmt.Println(varPair)
 			}
 		}
 		os.Exit(0) // Exit after displaying variables.
-	} else if exportMode {
+	} else if opts.export {
 		// Mode 3: Load into current shell (via `eval "$(setnv --export <id>)"`).
+		if len(fileKeys) > 0 {
+			// Nothing could remove the files once the shell is done with them.
+			fmt.Fprintf(os.Stderr, " » setnv: Warning: Variables are only delivered as files to an executable; exporting %s as variables.\n", strings.Join(fileKeys, ", "))
+		}
 		for _, varPair := range jointResolvedEnvVars {
 			parts := strings.SplitN(varPair, "=", 2)
 			if len(parts) == 2 {
@@ -553,16 +1116,45 @@ func main() {
 		}
 		// DO NOT `os.Exit(0)` here. The output of this program is intended to be evaluated
 		// by the calling shell, and a non-zero exit could abort the `eval` command.
+	} else if opts.procfile != "" {
+		// Mode 5: Run all processes of a Procfile under the same environment.
+		envMap := childEnv(jointResolvedEnvMap)
+		var secretFilesDir string
+		if len(fileKeys) > 0 {
+			if secretFilesDir, err = writeSecretFiles(envMap, fileKeys); err != nil {
+				fmt.Fprintf(os.Stderr, " » setnv: Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		if err := envResolver.runPreExecHooks(envResolver.preExecHooks, envMap); err != nil {
+			os.RemoveAll(secretFilesDir)
+			fmt.Fprintf(os.Stderr, " » setnv: Error: %v; not starting the processes of '%s'.\n", err, opts.procfile)
+			os.Exit(1)
+		}
+		runner := &procfileRunner{
+			entries:     procfileEntries,
+			env:         mapToSlice(envMap),
+			cmdExecutor: envResolver.cmdExecutor,
+			out:         os.Stdout,
+			color:       isTerminal(os.Stdout),
+			keepGoing:   opts.keepGoing,
+			grace:       procfileKillGrace,
+		}
+		status, err := runner.run()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error: %v\n", err)
+			status = 1
+		}
+		// Run before the secret files are removed, as hooks may need them.
+		envResolver.runPostExecHooks(envResolver.postExecHooks, envMap, status)
+		os.RemoveAll(secretFilesDir)
+		os.Exit(status)
 	} else {
 		// Mode 1 or 2: Run specified executable or launch a default subshell.
 		targetCmd := ""
 		if executable != "" {
 			// Mode 1: Run a specific executable.
-			targetCmd = executable
-			if strings.HasPrefix(targetCmd, "-") {
-				fmt.Fprintf(os.Stderr, " » setnv: Invalid option: %s\n", targetCmd)
-				os.Exit(1)
-			}
+			targetCmd = executable // Unknown options were rejected by parseArgs.
 		} else {
 			// Mode 2: Launch a default interactive subshell.
 			targetCmd = os.Getenv("SHELL") // Use user's preferred shell if set.
@@ -589,18 +1181,95 @@ func main() {
 			finalArgs = execArgs // If subshell, `execArgs` already contains `targetCmd` (shell) and `-i`.
 		}
 
-		var envp []string
-		if sandBoxed {
-			// Convert the joint resolved map back to a slice for `syscall.Exec`.
-			envp = mapToSlice(jointResolvedEnvMap)
-		} else {
-			// Prepare the full set of environment variables to pass to the executable
-			fullSetEnvMap := mergeMaps(osEnvMap, jointResolvedEnvMap)
+		// newResolvedEnv collects what launch needs from the resolution by r.
+		newResolvedEnv := func(r *resolver, jointResolvedEnvMap map[string]string) resolvedEnv {
+			fileKeys, _ := secretFileKeys(r, jointResolvedEnvMap, opts.asFiles)
+			return resolvedEnv{
+				vars:          jointResolvedEnvMap,
+				fileKeys:      fileKeys,
+				paths:         watchedPaths(envFilePaths, r),
+				preExecHooks:  r.preExecHooks,
+				postExecHooks: r.postExecHooks,
+			}
+		}
+
+		// launch runs the pre-exec hooks and starts the executable as a
+		// subprocess, so that setnv can clean up and run the post-exec hooks
+		// after it, with the variables in env.fileKeys delivered as files.
+		launch := func(env resolvedEnv) (*supervisor, error) {
+			envMap := childEnv(env.vars)
+			var secretFilesDir string
+			if len(env.fileKeys) > 0 {
+				dir, err := writeSecretFiles(envMap, env.fileKeys)
+				if err != nil {
+					return nil, err
+				}
+				secretFilesDir = dir
+			}
+			if err := envResolver.runPreExecHooks(env.preExecHooks, envMap); err != nil {
+				os.RemoveAll(secretFilesDir)
+				return nil, err
+			}
+
+			child := newSupervisor(absTargetCmd, finalArgs, mapToSlice(envMap))
+			if opts.supervise && !opts.watch {
+				child.onExit(func(status int) {
+					fmt.Fprintf(os.Stderr, " » setnv: '%s' exited with status %d.\n", targetCmd, status)
+				})
+			}
+			if secretFilesDir != "" {
+				child.onExit(func(int) { os.RemoveAll(secretFilesDir) })
+			}
+			if len(env.postExecHooks) > 0 {
+				// Run before the secret files are removed, as hooks may need them.
+				child.onExit(func(status int) { envResolver.runPostExecHooks(env.postExecHooks, envMap, status) })
+			}
+			return child, child.start()
+		}
 
-			// Convert to a slice for `syscall.Exec`.
-			envp = mapToSlice(fullSetEnvMap)
+		if opts.watch {
+			// Restart the executable whenever the environment changes.
+			session := &watchSession{
+				name: targetCmd,
+				resolve: func(ctx context.Context) (resolvedEnv, error) {
+					envResolver := newEnvResolver(ctx, opts)
+					jointResolvedEnvMap, err := resolveEnvFiles(envResolver, envFilePaths, opts.envOverrides, osEnvMap)
+					if err != nil {
+						return resolvedEnv{}, err
+					}
+					return newResolvedEnv(envResolver, jointResolvedEnvMap), nil
+				},
+				launch: launch,
+			}
+			ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stopSignals()
+			os.Exit(session.run(ctx, newResolvedEnv(envResolver, jointResolvedEnvMap)))
 		}
 
+		if opts.supervise || len(fileKeys) > 0 || len(envResolver.postExecHooks) > 0 {
+			// Secret files and post-exec hooks always require supervision.
+			child, err := launch(newResolvedEnv(envResolver, jointResolvedEnvMap))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, " » setnv: Error executing '%s': %v\n", absTargetCmd, err)
+				os.Exit(1)
+			}
+			status, err := child.wait()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, " » setnv: Error executing '%s': %v\n", absTargetCmd, err)
+				os.Exit(1)
+			}
+			os.Exit(status)
+		}
+
+		envMap := childEnv(jointResolvedEnvMap)
+		if err := envResolver.runPreExecHooks(envResolver.preExecHooks, envMap); err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error: %v; not starting '%s'.\n", err, targetCmd)
+			os.Exit(1)
+		}
+
+		// Convert to a slice for `syscall.Exec`.
+		envp := mapToSlice(envMap)
+
 		// Perform `syscall.Exec`. This replaces the current `setnv` Go process
 		// with the target command, passing the merged environment and arguments.
 		// `syscall.Exec` is a low-level call, typically used for this purpose on Unix-like systems.
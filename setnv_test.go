@@ -362,6 +362,30 @@ DB_PASSWORD=$(gopass show $SECRET_ID)`,
 				"DB_PASSWORD": "actual-db-pass",
 			},
 		},
+		{
+			name:       "Gopass Key Selection",
+			envContent: `DB_USER=$(gopass show my/service/db username)`,
+			mockedGenericCmds: map[string]struct {
+				stdout   string
+				stderr   string
+				exitCode int
+			}{
+				"bash -c gopass show my/service/db username": {stdout: "db-admin", stderr: "", exitCode: 0},
+			},
+			expectedMap: map[string]string{"DB_USER": "db-admin"},
+		},
+		{
+			name:       "Gopass Flags Passed Through",
+			envContent: `DB_PASS=$(gopass show -o my/service/db)`,
+			mockedGenericCmds: map[string]struct {
+				stdout   string
+				stderr   string
+				exitCode int
+			}{
+				"bash -c gopass show -o my/service/db": {stdout: "only-the-password", stderr: "", exitCode: 0},
+			},
+			expectedMap: map[string]string{"DB_PASS": "only-the-password"},
+		},
 	}
 
 	for _, tt := range tests {
@@ -469,6 +493,31 @@ DB_PASSWORD=$(gopass show $SECRET_ID)`,
 	}
 }
 
+// TestResolveEnvFilesOverrides checks that `-e KEY=VALUE` overrides are
+// resolved after all files, seeing and overriding their variables.
+func TestResolveEnvFilesOverrides(t *testing.T) {
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "dev.env")
+	if err := os.WriteFile(envFile, []byte("LOG_LEVEL=info\nPORT=8080\nURL=http://localhost:$PORT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	overrides := []string{"PORT=9000", `BANNER="$LOG_LEVEL on $(echo $PORT)"`}
+	actualMap, err := resolveEnvFiles(newResolver(defaultCommandExecutor), []string{envFile}, overrides, map[string]string{})
+	if err != nil {
+		t.Fatalf("resolveEnvFiles returned error: %v", err)
+	}
+	expectedMap := map[string]string{
+		"LOG_LEVEL": "info",
+		"PORT":      "9000",
+		"URL":       "http://localhost:8080", // Resolved before the override.
+		"BANNER":    "info on 9000",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+}
+
 // mapToSortedSlice is a helper function for tests.
 // It converts a map[string]string to a sorted slice of "KEY=VALUE" strings.
 // This is crucial for comparing map contents consistently in tests, as Go map
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// sopsMetadataPrefix prefixes the metadata keys SOPS appends to dotenv files.
+const sopsMetadataPrefix = "sops_"
+
+// sopsMACOnlyEncryptedInit seeds the MAC of files written with
+// `mac_only_encrypted`, exactly as SOPS does.
+var sopsMACOnlyEncryptedInit = []byte{0x8a, 0x3f, 0xd2, 0xad, 0x54, 0xce, 0x66, 0x52, 0x7b, 0x10, 0x34, 0xf3, 0xd1, 0x47, 0xbe, 0xb, 0xb, 0x97, 0x5b, 0x3b, 0xf4, 0x4f, 0x72, 0xc6, 0xfd, 0xad, 0xec, 0x81, 0x76, 0xf2, 0x7d, 0x69}
+
+// sopsValueRegex matches a SOPS-encrypted value.
+// Groups 1-3 capture the base64 data, IV and tag; group 4 the value type,
+// which is always `str` in dotenv files.
+var sopsValueRegex = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// sopsAgeEncRegex matches the metadata keys holding the data key encrypted to
+// an age recipient, e.g. `sops_age__list_0__map_enc`.
+var sopsAgeEncRegex = regexp.MustCompile(`^sops_age__list_\d+__map_enc$`)
+
+// sopsDotenvItem is one `KEY=VALUE` line of a SOPS dotenv file.
+type sopsDotenvItem struct {
+	key   string
+	value string
+}
+
+// isSopsDotenv reports whether content is a dotenv file encrypted by SOPS,
+// recognized by its `sops_mac` metadata line.
+func isSopsDotenv(content []byte) bool {
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte(sopsMetadataPrefix+"mac=")) {
+			return true
+		}
+	}
+	return false
+}
+
+// decryptSopsDotenv decrypts a SOPS dotenv file in-process, without the `sops`
+// binary. The data key is recovered with a local age identity, every
+// `ENC[AES256_GCM,...]` value is decrypted, and the file's MAC is verified.
+// The result is a plain .env file with the `sops_*` metadata removed, in which
+// decrypted values are quoted and escaped so that they are taken literally.
+func decryptSopsDotenv(content []byte) ([]byte, error) {
+	var items []sopsDotenvItem
+	metadata := make(map[string]string)
+
+	// Mirror SOPS' dotenv store: skip empty lines and comments (which SOPS
+	// encrypts as well), split at the first '=', and unescape `\n`.
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid dotenv line: %s", line)
+		}
+		value = strings.ReplaceAll(value, `\n`, "\n")
+		if strings.HasPrefix(key, sopsMetadataPrefix) {
+			metadata[key] = value
+		} else {
+			items = append(items, sopsDotenvItem{key: key, value: value})
+		}
+	}
+
+	dataKey, err := sopsDataKey(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha512.New()
+	macOnlyEncrypted := metadata["sops_mac_only_encrypted"] == "true"
+	if macOnlyEncrypted {
+		hash.Write(sopsMACOnlyEncryptedInit)
+	}
+
+	var out bytes.Buffer
+	for _, item := range items {
+		value := item.value
+		encrypted := sopsValueRegex.MatchString(value)
+		if encrypted {
+			if value, err = sopsDecryptValue(item.value, dataKey, item.key+":"); err != nil {
+				return nil, fmt.Errorf("could not decrypt value of '%s': %w", item.key, err)
+			}
+		}
+		if encrypted || !macOnlyEncrypted {
+			hash.Write([]byte(value))
+		}
+
+		if encrypted {
+			// Decrypted values are secrets, not setnv syntax: escape `$` and
+			// double-quote the value so parseEnvFile reads it back literally.
+			value = strconv.Quote(strings.ReplaceAll(value, "$", `\$`))
+		}
+		fmt.Fprintf(&out, "%s=%s\n", item.key, value)
+	}
+
+	if err := sopsVerifyMAC(metadata, dataKey, fmt.Sprintf("%X", hash.Sum(nil))); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// sopsDecryptValue decrypts a single `ENC[AES256_GCM,...]` value. SOPS binds
+// each value to its key by passing `<key>:` as additional authenticated data.
+func sopsDecryptValue(value string, dataKey []byte, additionalData string) (string, error) {
+	matches := sopsValueRegex.FindStringSubmatch(value)
+	if matches == nil {
+		return "", fmt.Errorf("value does not match the SOPS format")
+	}
+
+	var parts [3][]byte
+	for i := range parts {
+		decoded, err := base64.StdEncoding.DecodeString(matches[i+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid base64: %w", err)
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(iv))
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt with AES_GCM: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// sopsVerifyMAC decrypts the file's `sops_mac` and compares it with the MAC
+// computed over the decrypted values, detecting tampered or reordered entries.
+func sopsVerifyMAC(metadata map[string]string, dataKey []byte, computedMAC string) error {
+	lastModified, err := time.Parse(time.RFC3339, metadata["sops_lastmodified"])
+	if err != nil {
+		return fmt.Errorf("invalid sops_lastmodified: %w", err)
+	}
+	fileMAC, err := sopsDecryptValue(metadata["sops_mac"], dataKey, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("could not decrypt sops_mac: %w", err)
+	}
+	if fileMAC != computedMAC {
+		return fmt.Errorf("MAC mismatch: the file has been modified without SOPS")
+	}
+	return nil
+}
+
+// sopsDataKey recovers the SOPS data key from the age recipients stanzas in
+// metadata, trying every locally available age identity.
+func sopsDataKey(metadata map[string]string) ([]byte, error) {
+	identities := sopsAgeIdentities()
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no age identity found: set SETNV_AGE_IDENTITY, SOPS_AGE_KEY or SOPS_AGE_KEY_FILE")
+	}
+
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		if sopsAgeEncRegex.MatchString(k) {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the file is not encrypted to any age recipient")
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(metadata[k])), identities...)
+		if err != nil {
+			continue
+		}
+		dataKey, err := io.ReadAll(r)
+		if err == nil {
+			return dataKey, nil
+		}
+	}
+	return nil, fmt.Errorf("none of the local age identities can decrypt the data key")
+}
+
+// sopsAgeIdentities gathers the age identities that may decrypt a SOPS file:
+// setnv's own identity (see loadAgeIdentities), then the ones SOPS itself uses
+// from SOPS_AGE_KEY, SOPS_AGE_KEY_FILE, or <user config dir>/sops/age/keys.txt.
+func sopsAgeIdentities() []age.Identity {
+	var identities []age.Identity
+	if ids, err := loadAgeIdentities(); err == nil {
+		identities = append(identities, ids...)
+	}
+	if key := os.Getenv("SOPS_AGE_KEY"); key != "" {
+		if ids, err := age.ParseIdentities(strings.NewReader(key)); err == nil {
+			identities = append(identities, ids...)
+		}
+	}
+
+	keyFile := os.Getenv("SOPS_AGE_KEY_FILE")
+	if keyFile == "" {
+		userConfigDir := os.Getenv("XDG_CONFIG_HOME")
+		if userConfigDir == "" {
+			userConfigDir, _ = os.UserConfigDir()
+		}
+		keyFile = filepath.Join(userConfigDir, "sops", "age", "keys.txt")
+	}
+	if f, err := os.Open(keyFile); err == nil {
+		defer f.Close()
+		if ids, err := age.ParseIdentities(f); err == nil {
+			identities = append(identities, ids...)
+		}
+	}
+	return identities
+}
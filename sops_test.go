@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sopsTestKey is a throwaway age identity that sopsTestFile was encrypted to
+// with `sops encrypt --age <recipient> --input-type dotenv --output-type dotenv`.
+const sopsTestKey = "AGE-SECRET-KEY-12HUVQHHN7M2UVQEH98MA2W40NKPKSSF7AA8GF855RCA3MM0ECAXQJPP2D4"
+
+// sopsTestFile is the SOPS-encrypted form of:
+//
+//	# a comment
+//	DB_USER=admin
+//	DB_PASS=s3cr3t$x
+//	MULTI=line1\nline2
+//	PUBLIC_unencrypted=visible
+const sopsTestFile = `#ENC[AES256_GCM,data:J90Ous7UuLWD0w==,iv:hLPxckQVgngntwcGvwXcyoDfAzYS6RjkqIViCcIH2X4=,tag:lcM3aXG2pOq5vYAeWgOiHA==,type:comment]
+DB_USER=ENC[AES256_GCM,data:W5Ha0Ic=,iv:NGrnHOTe25Qa6Tf5AO4ULPsZB80M8g4Nq3KsNZWj3Sk=,tag:sFWbQ0LGNNM0cAfeRp4Zag==,type:str]
+DB_PASS=ENC[AES256_GCM,data:iG8cLutOwKk=,iv:JTsPG5a8FAe9tIC8Kk5ZjmU0cn+CDBwNfbFNcVhF7rU=,tag:IRWKF+3Fav5fDn/Y7gkF1A==,type:str]
+MULTI=ENC[AES256_GCM,data:Vwgwn20Mp8UdukA=,iv:CUz+aPCz2YLzTGY7WOrt/mgul8ahXojRlcXgCEg9Nxg=,tag:U1V7eGP3gw/0qZWpF/ZqpA==,type:str]
+PUBLIC_unencrypted=visible
+sops_age__list_0__map_enc=-----BEGIN AGE ENCRYPTED FILE-----\nYWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBOdjFSZHZpZHNjZjJoVmZH\nYVZPK3diWDN1S1NFVlNFMEpNdmxBQWZGbm5FCmI2aktHb0hrcEMwK2dmNWMzRHg4\nMlAwSWlHNWY3RDJ1R24vWHhjeWNhREkKLS0tIEVwMnJBMTVPY092YTJpaWRRWElu\nSWQybGRiNGd5eW9BVnBLa01rUmR0SzAKEXspuU5Enok61vaKerXRwHlm3TwDdCT3\nUoCStA7pQq8MwbGRfH/nW+3V1ZxLF/j/2Yln+VYI7okVhsL8rtayMQ==\n-----END AGE ENCRYPTED FILE-----\n
+sops_age__list_0__map_recipient=age1pqhsmxr8yyr676rfcxss4epy44k6eg840u2n4jmwjnqspwm9lassew6skv
+sops_lastmodified=2026-10-18T12:31:17Z
+sops_mac=ENC[AES256_GCM,data:dN2CLUC38rSKcflbFW8oyq/e5gOIV49eTogS5QLRBnV7eRyyIOjTn9WXyS8BjFFr5bwUTtsXPIzoH562512m7diOzEqI019Uo7vcn50aNvz0u0QX1LhKMth21ukNvRPXRPv46BBf9pAD04+5rTPV0oizpTgN7qXZldV9iWwkals=,iv:NIwGd6ySIVZyfgXTl7VFGdJfC8Dm/Ao0YHpowJ3XA/4=,tag:nRMQlRgG9BC1m9dirS/pTg==,type:str]
+sops_unencrypted_suffix=_unencrypted
+sops_version=3.9.0
+`
+
+// writeSopsTestFile writes content to a temporary .env file and points the
+// SOPS key lookup at sopsTestKey, returning the file's path.
+func writeSopsTestFile(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SETNV_CONFIG_DIR", dir)
+	t.Setenv("SETNV_AGE_IDENTITY", "")
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join(dir, "missing-keys.txt"))
+	t.Setenv("SOPS_AGE_KEY", sopsTestKey)
+
+	envFilePath := filepath.Join(dir, "app.env")
+	if err := ioutil.WriteFile(envFilePath, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write SOPS file: %v", err)
+	}
+	return envFilePath
+}
+
+// TestParseSopsEnvFile checks that a dotenv file written by SOPS is decrypted
+// in-process, with secret values taken literally.
+func TestParseSopsEnvFile(t *testing.T) {
+	envFilePath := writeSopsTestFile(t, sopsTestFile)
+
+	actualMap, err := parseEnvFile(envFilePath, mockCommand("", "unexpected command", 1), map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{
+		"DB_USER":            "admin",
+		"DB_PASS":            "s3cr3t" + literalDollarPlaceholder + "x",
+		"MULTI":              "line1\nline2",
+		"PUBLIC_unencrypted": "visible",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+}
+
+// TestSopsEnvFileErrors checks that tampering and missing keys are reported.
+func TestSopsEnvFileErrors(t *testing.T) {
+	t.Run("Tampered Unencrypted Value", func(t *testing.T) {
+		envFilePath := writeSopsTestFile(t, strings.Replace(sopsTestFile, "=visible", "=changed", 1))
+		if _, err := parseEnvFile(envFilePath, defaultCommandExecutor, map[string]string{}); err == nil || !strings.Contains(err.Error(), "MAC mismatch") {
+			t.Errorf("Expected a MAC mismatch error, Got: %v", err)
+		}
+	})
+
+	t.Run("Swapped Encrypted Values", func(t *testing.T) {
+		lines := strings.Split(sopsTestFile, "\n")
+		user, pass := strings.TrimPrefix(lines[1], "DB_USER="), strings.TrimPrefix(lines[2], "DB_PASS=")
+		lines[1], lines[2] = "DB_USER="+pass, "DB_PASS="+user
+		envFilePath := writeSopsTestFile(t, strings.Join(lines, "\n"))
+		if _, err := parseEnvFile(envFilePath, defaultCommandExecutor, map[string]string{}); err == nil || !strings.Contains(err.Error(), "could not decrypt value") {
+			t.Errorf("Expected a decryption error, Got: %v", err)
+		}
+	})
+
+	t.Run("No Matching Identity", func(t *testing.T) {
+		envFilePath := writeSopsTestFile(t, sopsTestFile)
+		t.Setenv("SOPS_AGE_KEY", "")
+		if _, err := parseEnvFile(envFilePath, defaultCommandExecutor, map[string]string{}); err == nil || !strings.Contains(err.Error(), "no age identity") {
+			t.Errorf("Expected a missing identity error, Got: %v", err)
+		}
+	})
+}
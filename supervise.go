@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// forwardedSignals are the signals a supervising setnv passes on to its child.
+var forwardedSignals = []os.Signal{
+	syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT,
+	syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH, syscall.SIGALRM,
+	syscall.SIGCONT,
+}
+
+// terminalSignals are the forwarded signals a terminal sends to its whole
+// foreground process group. A child on the same terminal receives them itself,
+// so forwarding them would deliver them twice (e.g., two Ctrl-Cs).
+var terminalSignals = map[os.Signal]bool{syscall.SIGINT: true, syscall.SIGQUIT: true}
+
+// supervisor runs an executable as a subprocess of setnv, rather than
+// replacing setnv with it, so that setnv can act after the executable exits.
+type supervisor struct {
+	path string   // The executable.
+	argv []string // Its arguments, including argv[0].
+	env  []string // Its environment, as "KEY=VALUE" pairs.
+
+	// exitHooks are run, in reverse order of registration, after the child
+	// exits or fails to start.
+	exitHooks []func(status int)
+
+	cmd    *exec.Cmd
+	done   chan struct{} // Closed once the child has exited and the hooks have run.
+	status int           // The exit status, once done is closed.
+	err    error         // Why waiting for the child failed, once done is closed.
+}
+
+func newSupervisor(path string, argv []string, env []string) *supervisor {
+	return &supervisor{path: path, argv: argv, env: env, done: make(chan struct{})}
+}
+
+// onExit registers hook to be run with the child's exit status after it exits,
+// e.g. to remove secret files. Hooks registered later run first.
+func (s *supervisor) onExit(hook func(status int)) {
+	s.exitHooks = append(s.exitHooks, hook)
+}
+
+// run starts the child and waits for it to exit (see start and wait).
+func (s *supervisor) run() (int, error) {
+	if err := s.start(); err != nil {
+		return 0, err
+	}
+	return s.wait()
+}
+
+// start starts the child on setnv's standard streams and forwards the signals
+// sent to setnv to it until it exits. If the child cannot be started, the exit
+// hooks are run with status 1.
+func (s *supervisor) start() error {
+	s.cmd = &exec.Cmd{
+		Path:   s.path,
+		Args:   s.argv,
+		Env:    s.env,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	// Notify before starting, so that no signal kills setnv without the child.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	if err := s.cmd.Start(); err != nil {
+		signal.Stop(signals)
+		s.runExitHooks(1)
+		return err
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		sharesTerminal := isTerminal(os.Stdin)
+		for {
+			select {
+			case sig := <-signals:
+				if sharesTerminal && terminalSignals[sig] {
+					continue // The child got it from the terminal, too.
+				}
+				s.cmd.Process.Signal(sig)
+			case <-exited:
+				signal.Stop(signals)
+				return
+			}
+		}
+	}()
+	go func() {
+		s.status, s.err = exitStatus(s.cmd, s.cmd.Wait())
+		close(exited)
+		hookStatus := s.status
+		if s.err != nil {
+			hookStatus = 1
+		}
+		s.runExitHooks(hookStatus)
+		close(s.done)
+	}()
+	return nil
+}
+
+// wait waits until the started child has exited and the exit hooks have run.
+// It returns the child's exit status, or 128+n if it was killed by signal n,
+// as a shell reports it.
+func (s *supervisor) wait() (int, error) {
+	<-s.done
+	return s.status, s.err
+}
+
+// exited returns a channel that is closed once wait would return.
+func (s *supervisor) exited() <-chan struct{} {
+	return s.done
+}
+
+// stop asks the started child to exit with SIGTERM and, if it is still running
+// after grace, kills it. It returns once the child has exited.
+func (s *supervisor) stop(grace time.Duration) {
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.done:
+	case <-time.After(grace):
+		s.cmd.Process.Kill()
+		<-s.done
+	}
+}
+
+// runExitHooks runs the exit hooks, the latest registered first.
+func (s *supervisor) runExitHooks(status int) {
+	for i := len(s.exitHooks) - 1; i >= 0; i-- {
+		s.exitHooks[i](status)
+	}
+}
+
+// exitStatus returns the exit status of cmd after cmd.Wait returned err.
+func exitStatus(cmd *exec.Cmd, err error) (int, error) {
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return 0, err
+	}
+	return cmd.ProcessState.ExitCode(), nil
+}
+
+// isTerminal reports whether f is a terminal, i.e. a character device other
+// than /dev/null.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, null)
+}
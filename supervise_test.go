@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestSupervisorExitStatus checks that the child's exit status is reported as
+// a shell would, and passed to the exit hooks.
+func TestSupervisorExitStatus(t *testing.T) {
+	tests := []struct {
+		script   string
+		expected int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -TERM $$", 128 + 15},
+	}
+	for _, tt := range tests {
+		child := newSupervisor("/bin/sh", []string{"sh", "-c", tt.script}, nil)
+		hookStatus := -1
+		child.onExit(func(status int) { hookStatus = status })
+
+		status, err := child.run()
+		if err != nil || status != tt.expected {
+			t.Errorf("run(%q) = %d, %v; expected %d", tt.script, status, err, tt.expected)
+		}
+		if hookStatus != tt.expected {
+			t.Errorf("Exit hook of %q got status %d, expected %d", tt.script, hookStatus, tt.expected)
+		}
+	}
+}
+
+// TestSupervisorExitHooks checks that exit hooks run in reverse order of
+// registration, also when the child cannot be started.
+func TestSupervisorExitHooks(t *testing.T) {
+	var calls []string
+	child := newSupervisor("/nonexistent/executable", []string{"nope"}, nil)
+	child.onExit(func(int) { calls = append(calls, "first") })
+	child.onExit(func(int) { calls = append(calls, "second") })
+
+	if _, err := child.run(); err == nil {
+		t.Errorf("Expected an error for a missing executable")
+	}
+	if expected := []string{"second", "first"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected hooks to run as %v, Got %v", expected, calls)
+	}
+}
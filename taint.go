@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maskedValue replaces sensitive values in `--view` output.
+const maskedValue = "****"
+
+// markSensitive records whether the value of entry is sensitive, that is,
+// derived from a command substitution or secret reference, either directly or
+// through a `$VAR` whose value is. Entries must be marked in file order, and
+// chained files in chain order, so that a reference sees the taint of the
+// definition it expands to, and a later static definition clears it.
+func (r *resolver) markSensitive(entry envEntry) {
+	sensitive := hasSubstitution(entry.value)
+	for name := range referencedVars(entry.value) {
+		sensitive = sensitive || r.sensitive[name]
+	}
+	r.sensitive[entry.key] = sensitive
+}
+
+// isSensitive reports whether the resolved value of the variable key is
+// sensitive (see markSensitive).
+func (r *resolver) isSensitive(key string) bool {
+	return r.sensitive[key]
+}
+
+// maskValue returns what `--view` shows in place of a sensitive value: the
+// mask, followed by its fingerprint if showFingerprint is set. Empty values
+// are shown as they are, since a failed lookup is worth seeing.
+func maskValue(value string, showFingerprint bool) string {
+	if value == "" {
+		return value
+	}
+	if showFingerprint {
+		return maskedValue + " " + fingerprint(value)
+	}
+	return maskedValue
+}
+
+// fingerprintKeyFile is the file in the cache directory (see cacheDir) that
+// holds the key fingerprints are computed with.
+const fingerprintKeyFile = "fingerprint.key"
+
+// fingerprintKeySize is the size of the fingerprint key, in bytes.
+const fingerprintKeySize = 32
+
+var (
+	fingerprintKeyOnce sync.Once
+	fingerprintKey     []byte
+)
+
+// fingerprint returns a short HMAC-SHA256 of value, which tells whether two
+// values are the same without revealing them. The key is random and local to
+// the user (see loadFingerprintKey), so the fingerprint of a guessed value
+// cannot be computed elsewhere to confirm the guess, however short or common
+// the value.
+func fingerprint(value string) string {
+	fingerprintKeyOnce.Do(func() { fingerprintKey = loadFingerprintKey() })
+	mac := hmac.New(sha256.New, fingerprintKey)
+	mac.Write([]byte(value))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:4])
+}
+
+// loadFingerprintKey returns the key in fingerprintKeyFile, creating it if
+// needed, so that fingerprints stay the same across invocations. If the file
+// cannot be read or written, the key is random and only lasts for this
+// invocation, which still tells values apart within it (e.g., in `setnv diff`).
+func loadFingerprintKey() []byte {
+	key := make([]byte, fingerprintKeySize)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms.
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return key
+	}
+	path := filepath.Join(dir, fingerprintKeyFile)
+	if existing, err := os.ReadFile(path); err == nil && len(existing) == fingerprintKeySize {
+		return existing
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return key
+	}
+	// Write the key to a temporary file and link it in place, so that
+	// concurrent invocations agree on the first complete key.
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return key
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(key)
+	if closeErr := tmp.Close(); err != nil || closeErr != nil {
+		return key
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if existing, err := os.ReadFile(path); err == nil && len(existing) == fingerprintKeySize {
+			return existing
+		}
+	}
+	return key
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSensitiveVariables checks that values derived from substitutions are
+// marked sensitive, through `$VAR` expansion and across chained files, and
+// that a later static definition clears the mark.
+func TestSensitiveVariables(t *testing.T) {
+	dir := t.TempDir()
+	firstFile := filepath.Join(dir, "first.env")
+	secondFile := filepath.Join(dir, "second.env")
+	firstContent := `HOST=db.internal
+TOKEN=$(echo s3cret)
+AUTH="Bearer ${TOKEN}"
+URL=https://$HOST/
+ESCAPED=\$(echo not-run)
+OVERRIDDEN=$[echo secret]
+`
+	secondContent := `OVERRIDDEN=plain
+HEADER=$AUTH
+PASSWORD=${secret:file:` + filepath.Join(dir, "first.env") + `}
+`
+	if err := ioutil.WriteFile(firstFile, []byte(firstContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	if err := ioutil.WriteFile(secondFile, []byte(secondContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	expected := map[string]bool{
+		"HOST":       false,
+		"TOKEN":      true,
+		"AUTH":       true,
+		"URL":        false,
+		"ESCAPED":    false,
+		"OVERRIDDEN": false,
+		"HEADER":     true,
+		"PASSWORD":   true,
+	}
+	for _, jobs := range []int{1, 4} {
+		r := newResolver(defaultCommandExecutor)
+		r.setJobs(jobs)
+		firstMap, err := r.parseEnvFile(firstFile, map[string]string{})
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		if _, err := r.parseEnvFile(secondFile, firstMap); err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		for key, sensitive := range expected {
+			if r.isSensitive(key) != sensitive {
+				t.Errorf("jobs=%d: isSensitive(%q) = %t, expected %t", jobs, key, r.isSensitive(key), sensitive)
+			}
+		}
+	}
+}
+
+// useFingerprintKeyDir makes fingerprint use a new key, kept in a temporary
+// cache directory, which it returns.
+func useFingerprintKeyDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SETNV_CACHE_DIR", dir)
+	fingerprintKeyOnce = sync.Once{}
+	t.Cleanup(func() { fingerprintKeyOnce = sync.Once{} })
+	return dir
+}
+
+// TestMaskValue checks the masks and fingerprints shown by `--view`.
+func TestMaskValue(t *testing.T) {
+	useFingerprintKeyDir(t)
+	if got := maskValue("s3cret", false); got != maskedValue {
+		t.Errorf("maskValue without fingerprint = %q, expected %q", got, maskedValue)
+	}
+	if got := maskValue("", true); got != "" {
+		t.Errorf("maskValue of an empty value = %q, expected it unchanged", got)
+	}
+
+	withFingerprint := maskValue("s3cret", true)
+	if !strings.HasPrefix(withFingerprint, maskedValue+" hmac:") || strings.Contains(withFingerprint, "s3cret") {
+		t.Errorf("maskValue with fingerprint = %q", withFingerprint)
+	}
+	if withFingerprint != maskValue("s3cret", true) || withFingerprint == maskValue("other", true) {
+		t.Errorf("Expected fingerprints to identify values")
+	}
+}
+
+// TestFingerprintKey checks that fingerprints are keyed by a key that is kept
+// private in the cache directory, and reused by later invocations.
+func TestFingerprintKey(t *testing.T) {
+	dir := useFingerprintKeyDir(t)
+	first := fingerprint("s3cret")
+
+	info, err := os.Stat(filepath.Join(dir, fingerprintKeyFile))
+	if err != nil {
+		t.Fatalf("Expected the key to be saved: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the key file to have mode 0600, Got %o", info.Mode().Perm())
+	}
+	sum := sha256.Sum256([]byte("s3cret"))
+	if first == "hmac:"+hex.EncodeToString(sum[:4]) {
+		t.Errorf("Expected the fingerprint to be keyed, Got the plain hash %q", first)
+	}
+
+	fingerprintKeyOnce = sync.Once{} // As in a later invocation.
+	if again := fingerprint("s3cret"); again != first {
+		t.Errorf("Expected the saved key to be reused, Got %q and %q", first, again)
+	}
+
+	useFingerprintKeyDir(t) // Another user.
+	if other := fingerprint("s3cret"); other == first {
+		t.Errorf("Expected another key to give another fingerprint, Got %q", other)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// terminalMu is held by the command that the terminal is lent to, as only one
+// process group can be in the foreground at a time.
+var terminalMu sync.Mutex
+
+// takeTerminal returns the controlling terminal of setnv if setnv is in its
+// foreground process group and no other command has the terminal, or nil.
+// The caller makes its command the foreground group, so that the command can
+// prompt on /dev/tty, and calls releaseTerminal once it has exited.
+func takeTerminal() *os.File {
+	if !terminalMu.TryLock() {
+		return nil
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		terminalMu.Unlock()
+		return nil // No controlling terminal.
+	}
+	if pgrp, err := terminalProcessGroup(tty); err != nil || pgrp != syscall.Getpgrp() {
+		tty.Close()
+		terminalMu.Unlock()
+		return nil // In the background, e.g. `setnv dev -- cmd &`.
+	}
+	return tty
+}
+
+// releaseTerminal makes the process group of setnv the foreground group of tty
+// again, and closes it.
+func releaseTerminal(tty *os.File) {
+	defer terminalMu.Unlock()
+	defer tty.Close()
+	// Changing the foreground group from the background sends SIGTTOU, which
+	// would stop setnv.
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	pgrp := int32(syscall.Getpgrp())
+	syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp)))
+}
+
+// terminalProcessGroup returns the foreground process group of tty.
+func terminalProcessGroup(tty *os.File) (int, error) {
+	var pgrp int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, tty.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp))); errno != 0 {
+		return 0, errno
+	}
+	return int(pgrp), nil
+}
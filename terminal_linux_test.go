@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// TestRunProcessPromptsOnTerminal checks that a command can read from
+// /dev/tty when setnv runs in the foreground of a terminal, and that setnv
+// gets the terminal back afterwards. setnv is played by this test binary,
+// run in a new session on a pseudo-terminal.
+func TestRunProcessPromptsOnTerminal(t *testing.T) {
+	if os.Getenv("SETNV_TEST_TERMINAL") == "1" {
+		runTerminalHelper()
+		return
+	}
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("No pseudo-terminals: %v", err)
+	}
+	defer master.Close()
+	var unlock int32
+	var ptn uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Skipf("Could not unlock the pseudo-terminal: %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&ptn))); errno != 0 {
+		t.Skipf("Could not get the pseudo-terminal number: %v", errno)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", ptn), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("Could not open the pseudo-terminal: %v", err)
+	}
+	defer slave.Close()
+
+	helper := exec.Command(os.Args[0], "-test.run=^TestRunProcessPromptsOnTerminal$")
+	helper.Env = append(os.Environ(), "SETNV_TEST_TERMINAL=1")
+	helper.Stdin, helper.Stdout, helper.Stderr = slave, slave, slave
+	helper.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := helper.Start(); err != nil {
+		t.Fatalf("Failed to start the helper: %v", err)
+	}
+	defer helper.Process.Kill()
+	if _, err := master.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Failed to type on the terminal: %v", err)
+	}
+
+	var output bytes.Buffer
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		buf := make([]byte, 1024)
+		for !strings.Contains(output.String(), "foreground:") || !strings.HasSuffix(output.String(), "\n") {
+			n, err := master.Read(buf)
+			if err != nil {
+				return
+			}
+			output.Write(buf[:n])
+		}
+	}()
+	select {
+	case <-read:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("The helper did not finish, Got:\n%s", output.String())
+	}
+	out := strings.ReplaceAll(output.String(), "\r", "")
+	if !strings.Contains(out, "output:got hello\n") {
+		t.Errorf("Expected the command to read from the terminal, Got:\n%s", out)
+	}
+	if !strings.Contains(out, "foreground:true\n") {
+		t.Errorf("Expected setnv to be in the foreground again, Got:\n%s", out)
+	}
+}
+
+// runTerminalHelper is setnv in TestRunProcessPromptsOnTerminal: it runs a
+// command that prompts on /dev/tty, and reports its output and whether it is
+// in the foreground afterwards.
+func runTerminalHelper() {
+	var stdout bytes.Buffer
+	cmd := exec.Command("bash", "-c", `IFS= read -r line < /dev/tty && echo "got $line"`)
+	cmd.Stdout = &stdout
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := runProcess(ctx, cmd); err != nil {
+		fmt.Printf("error:%v\n", err)
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	foreground := false
+	if err == nil {
+		pgrp, err := terminalProcessGroup(tty)
+		foreground = err == nil && pgrp == syscall.Getpgrp()
+		tty.Close()
+	}
+	fmt.Printf("output:%sforeground:%t\n", stdout.String(), foreground)
+}
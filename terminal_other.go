@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// takeTerminal is only implemented on Linux; elsewhere, commands always run in
+// the background and cannot prompt on /dev/tty.
+func takeTerminal() *os.File {
+	return nil
+}
+
+func releaseTerminal(tty *os.File) {}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultProvider resolves `${secret:vault:<path>#<field>}` from a HashiCorp Vault
+// KV secrets engine over its HTTP API. Both KV v1 (`secret/app`) and KV v2
+// (`kv/data/app`) paths are supported. The server, token and namespace come from
+// VAULT_ADDR, VAULT_TOKEN (or the token file, see vaultToken) and VAULT_NAMESPACE,
+// which may be set in the environment or in earlier .env lines.
+//
+// Each distinct secret is fetched only once per resolution, however many
+// fields of it are referenced, and the secrets of one file are fetched
+// concurrently (see ResolveBatch).
+type vaultProvider struct {
+	client *http.Client
+}
+
+// vaultFetches are the reads of Vault secrets made for one resolution, by
+// path and Vault settings (address, namespace and token). Every resolver has its own (see
+// withVaultFetches), so that a --watch restart sees rotated secrets.
+type vaultFetches struct {
+	mu      sync.Mutex
+	fetches map[string]*vaultFetch
+}
+
+// vaultFetch is the read of one Vault secret, shared by every reference to it.
+type vaultFetch struct {
+	mu     sync.Mutex
+	done   bool // Whether the result is final; see isTransientFetchError.
+	secret map[string]interface{}
+	err    error
+}
+
+func newVaultFetches() *vaultFetches {
+	return &vaultFetches{fetches: make(map[string]*vaultFetch)}
+}
+
+// vaultFetchesKey is the context key of the vaultFetches of a resolution.
+type vaultFetchesKey struct{}
+
+// withVaultFetches returns ctx with the fetches that the Vault provider shares
+// between the lookups made with it.
+func withVaultFetches(ctx context.Context, fetches *vaultFetches) context.Context {
+	return context.WithValue(ctx, vaultFetchesKey{}, fetches)
+}
+
+func newVaultProvider(timeout time.Duration) *vaultProvider {
+	return &vaultProvider{client: &http.Client{Timeout: timeout}}
+}
+
+func (p *vaultProvider) ContextVars() []string {
+	return []string{"VAULT_ADDR", "VAULT_NAMESPACE", "VAULT_TOKEN", "VAULT_TOKEN_FILE"}
+}
+
+func (p *vaultProvider) Resolve(ctx context.Context, ref secretRef, _ commandExecutor, env map[string]string) (string, error) {
+	secret, err := p.fetch(ctx, ref.path, env)
+	if err != nil {
+		return "", err
+	}
+
+	field := ref.field
+	if field == "" {
+		if len(secret) != 1 {
+			return "", fmt.Errorf("vault secret '%s' has %d fields (%s); select one with '#<field>'", ref.path, len(secret), strings.Join(sortedKeys(secret), ", "))
+		}
+		field = sortedKeys(secret)[0]
+	}
+
+	value, ok := secret[field]
+	if !ok {
+		return "", fmt.Errorf("field '%s' not found in vault secret '%s'", field, ref.path)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// ResolveBatch fetches the distinct secrets behind refs concurrently and then
+// resolves each reference from them.
+func (p *vaultProvider) ResolveBatch(ctx context.Context, refs []secretRef, _ commandExecutor, env map[string]string) map[secretRef]string {
+	var wg sync.WaitGroup
+	fetched := make(map[string]bool)
+	for _, ref := range refs {
+		if fetched[ref.path] {
+			continue
+		}
+		fetched[ref.path] = true
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			_, _ = p.fetch(ctx, path, env) // Errors are reported when the reference is resolved.
+		}(ref.path)
+	}
+	wg.Wait()
+
+	values := make(map[secretRef]string)
+	for _, ref := range refs {
+		if value, err := p.Resolve(ctx, ref, nil, env); err == nil {
+			values[ref] = value
+		}
+	}
+	return values
+}
+
+// fetch returns the key/value data stored at path. Within a resolution (see
+// withVaultFetches), Vault is only asked once per secret; later and concurrent
+// callers share the first result, unless it was transient (see
+// isTransientFetchError), which the next caller tries again.
+func (p *vaultProvider) fetch(ctx context.Context, path string, env map[string]string) (map[string]interface{}, error) {
+	addr := strings.TrimSuffix(env["VAULT_ADDR"], "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	namespace := env["VAULT_NAMESPACE"]
+	shared, ok := ctx.Value(vaultFetchesKey{}).(*vaultFetches)
+	if !ok {
+		return p.read(ctx, addr, namespace, path, env)
+	}
+
+	fetchKey := secretMemoKey(secretRef{scheme: "vault", path: path}, env)
+	shared.mu.Lock()
+	f, ok := shared.fetches[fetchKey]
+	if !ok {
+		f = &vaultFetch{}
+		shared.fetches[fetchKey] = f
+	}
+	shared.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return f.secret, f.err
+	}
+	secret, err := p.read(ctx, addr, namespace, path, env)
+	if err != nil && isTransientFetchError(ctx, err) {
+		return nil, err
+	}
+	f.secret, f.err, f.done = secret, err, true
+	return secret, err
+}
+
+// vaultUnavailableError is a failed read that says nothing about the secret:
+// the request failed, or Vault returned a server error. It may succeed when
+// retried (see --retry).
+type vaultUnavailableError struct {
+	err error
+}
+
+func (e vaultUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e vaultUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// isTransientFetchError reports whether err, returned by a read with ctx, is
+// a timeout, interruption, or unavailable server rather than an answer from
+// Vault. Such failures are not shared, so a retry asks Vault again.
+func isTransientFetchError(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.As(err, &vaultUnavailableError{})
+}
+
+// read performs the HTTP request for the secret at path.
+func (p *vaultProvider) read(ctx context.Context, addr, namespace, path string, env map[string]string) (map[string]interface{}, error) {
+	token, err := vaultToken(env)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, vaultUnavailableError{fmt.Errorf("vault request failed: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []string               `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid vault response for '%s': %w", path, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("vault secret '%s' not found", path)
+	case resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("permission denied reading vault secret '%s' (is the token valid?)", path)
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return nil, vaultUnavailableError{fmt.Errorf("vault returned %s for '%s': %s", resp.Status, path, strings.Join(body.Errors, "; "))}
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("vault returned %s for '%s': %s", resp.Status, path, strings.Join(body.Errors, "; "))
+	}
+
+	secret := body.Data
+	// KV v2 nests the key/value pairs under `data`, next to the version `metadata`.
+	if nested, ok := secret["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := secret["metadata"]; hasMetadata {
+			secret = nested
+		}
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("vault secret '%s' has no data (deleted version?)", path)
+	}
+	return secret, nil
+}
+
+// vaultToken returns the Vault token from VAULT_TOKEN, or else from the file
+// named by VAULT_TOKEN_FILE, or else from ~/.vault-token as written by `vault login`.
+func vaultToken(env map[string]string) (string, error) {
+	if token := env["VAULT_TOKEN"]; token != "" {
+		return token, nil
+	}
+
+	tokenFile := env["VAULT_TOKEN_FILE"]
+	if tokenFile == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("VAULT_TOKEN is not set and the home directory is unknown: %w", err)
+		}
+		tokenFile = filepath.Join(homeDir, ".vault-token")
+	}
+	content, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("VAULT_TOKEN is not set and the token file could not be read: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// sortedKeys returns the keys of m in alphabetical order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newVaultTestServer starts an httptest stand-in for Vault serving a KV v2
+// secret at `kv/data/app` and a KV v1 secret at `secret/legacy`. It counts the
+// requests it receives and checks the token and namespace headers.
+func newVaultTestServer(t *testing.T, requests *int32) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/kv/data/app":
+			fmt.Fprint(w, `{"data":{"data":{"username":"app","password":"s3cret","port":5432},"metadata":{"version":3}}}`)
+		case "/v1/secret/legacy":
+			fmt.Fprint(w, `{"data":{"api_key":"legacy-key"}}`)
+		case "/v1/ns/data/scoped":
+			if r.Header.Get("X-Vault-Namespace") != "team-a" {
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `{"errors":[]}`)
+				return
+			}
+			fmt.Fprint(w, `{"data":{"data":{"value":"scoped"},"metadata":{}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// TestVaultProvider exercises KV v1 and v2 reads, field selection, namespaces
+// and error reporting against an httptest server.
+func TestVaultProvider(t *testing.T) {
+	var requests int32
+	server := newVaultTestServer(t, &requests)
+
+	tokenFile := filepath.Join(t.TempDir(), "vault-token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		ref           secretRef
+		env           map[string]string
+		expected      string
+		expectedError string
+	}{
+		{
+			name:     "KV v2 Field",
+			ref:      secretRef{scheme: "vault", path: "kv/data/app", field: "password"},
+			env:      map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"},
+			expected: "s3cret",
+		},
+		{
+			name:     "KV v2 Non-String Field",
+			ref:      secretRef{scheme: "vault", path: "kv/data/app", field: "port"},
+			env:      map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"},
+			expected: "5432",
+		},
+		{
+			name:     "KV v1 Single Field Without Selector",
+			ref:      secretRef{scheme: "vault", path: "secret/legacy"},
+			env:      map[string]string{"VAULT_ADDR": server.URL + "/", "VAULT_TOKEN_FILE": tokenFile},
+			expected: "legacy-key",
+		},
+		{
+			name:     "Namespace Header",
+			ref:      secretRef{scheme: "vault", path: "ns/data/scoped"},
+			env:      map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token", "VAULT_NAMESPACE": "team-a"},
+			expected: "scoped",
+		},
+		{
+			name:          "Ambiguous Field",
+			ref:           secretRef{scheme: "vault", path: "kv/data/app"},
+			env:           map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"},
+			expectedError: "select one with '#<field>'",
+		},
+		{
+			name:          "Missing Field",
+			ref:           secretRef{scheme: "vault", path: "kv/data/app", field: "email"},
+			env:           map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"},
+			expectedError: "field 'email' not found",
+		},
+		{
+			name:          "Missing Secret",
+			ref:           secretRef{scheme: "vault", path: "kv/data/nope", field: "x"},
+			env:           map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"},
+			expectedError: "not found",
+		},
+		{
+			name:          "Bad Token",
+			ref:           secretRef{scheme: "vault", path: "kv/data/app", field: "password"},
+			env:           map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "wrong"},
+			expectedError: "permission denied",
+		},
+		{
+			name:          "Missing Address",
+			ref:           secretRef{scheme: "vault", path: "kv/data/app", field: "password"},
+			env:           map[string]string{"VAULT_TOKEN": "test-token"},
+			expectedError: "VAULT_ADDR is not set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newVaultProvider(time.Second)
+			actual, err := provider.Resolve(context.Background(), tt.ref, nil, tt.env)
+			if tt.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("Expected error containing %q, Got: %v", tt.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve returned error: %v", err)
+			}
+			if actual != tt.expected {
+				t.Errorf("Expected %q, Got %q", tt.expected, actual)
+			}
+		})
+	}
+}
+
+// TestParseEnvFileVaultFetchOnce checks that several keys referencing fields of
+// the same Vault secret cause a single request.
+func TestParseEnvFileVaultFetchOnce(t *testing.T) {
+	var requests int32
+	server := newVaultTestServer(t, &requests)
+
+	envFile := filepath.Join(t.TempDir(), "vault.env")
+	envContent := fmt.Sprintf(`VAULT_ADDR=%s
+VAULT_TOKEN=test-token
+DB_USER=${secret:vault:kv/data/app#username}
+DB_PASS=${secret:vault:kv/data/app#password}
+DB_URL=postgres://${secret:vault:kv/data/app#username}:${secret:vault:kv/data/app#password}@db`, server.URL)
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	actualMap, err := parseEnvFile(envFile, defaultCommandExecutor, map[string]string{})
+	if err != nil {
+		t.Fatalf("parseEnvFile returned error: %v", err)
+	}
+	expectedMap := map[string]string{
+		"VAULT_ADDR":  server.URL,
+		"VAULT_TOKEN": "test-token",
+		"DB_USER":     "app",
+		"DB_PASS":     "s3cret",
+		"DB_URL":      "postgres://app:s3cret@db",
+	}
+	if !reflect.DeepEqual(actualMap, expectedMap) {
+		t.Errorf("Expected %v, Got %v", mapToSortedSlice(expectedMap), mapToSortedSlice(actualMap))
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected 1 request to Vault, Got %d", n)
+	}
+}
+
+// TestVaultFetchesPerResolution checks that Vault secrets are read again by
+// every resolution, as --watch does, and that a timed-out read is not shared.
+func TestVaultFetchesPerResolution(t *testing.T) {
+	var requests int32
+	server := newVaultTestServer(t, &requests)
+	env := map[string]string{"VAULT_ADDR": server.URL, "VAULT_TOKEN": "test-token"}
+	ref := secretRef{scheme: "vault", path: "kv/data/app", field: "password"}
+
+	for i := 0; i < 2; i++ {
+		r := newResolver(defaultCommandExecutor)
+		if value := r.applySecretReferences("${secret:vault:kv/data/app#password}", "DB_PASS", "test.env", 1, entryOptions{}, env, nil, io.Discard); value != "s3cret" {
+			t.Fatalf("Expected %q, Got %q", "s3cret", value)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 1 request per resolution, Got %d", n)
+	}
+
+	var slowRequests int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&slowRequests, 1) == 1 {
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprint(w, `{"data":{"data":{"password":"s3cret"},"metadata":{}}}`)
+	}))
+	t.Cleanup(slow.Close)
+	env["VAULT_ADDR"] = slow.URL
+
+	provider := newVaultProvider(time.Second)
+	ctx := withVaultFetches(context.Background(), newVaultFetches())
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := provider.Resolve(short, ref, nil, env); err == nil {
+		t.Fatalf("Expected the first read to time out")
+	}
+	if value, err := provider.Resolve(ctx, ref, nil, env); err != nil || value != "s3cret" {
+		t.Errorf("Expected the timeout not to be shared, Got %q, %v", value, err)
+	}
+}
+
+// TestParseEnvFileVaultSettingsPerReference checks that a reference resolved
+// after VAULT_ADDR or VAULT_TOKEN is redefined does not reuse a read made with
+// the earlier settings.
+func TestParseEnvFileVaultSettingsPerReference(t *testing.T) {
+	var requests int32
+	server := newVaultTestServer(t, &requests)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"data":{"data":{"password":"other"},"metadata":{}}}`)
+	}))
+	t.Cleanup(other.Close)
+
+	envFile := filepath.Join(t.TempDir(), "vault.env")
+	envContent := fmt.Sprintf(`VAULT_ADDR=%s
+VAULT_TOKEN=test-token
+A=${secret:vault:kv/data/app#password}
+VAULT_ADDR=%s
+B=${secret:vault:kv/data/app#password}
+VAULT_ADDR=%s
+VAULT_TOKEN=wrong
+C=${secret:vault:kv/data/app#password}
+VAULT_TOKEN=test-token
+D=${secret:vault:kv/data/app#password}`, server.URL, other.URL, server.URL)
+	if err := ioutil.WriteFile(envFile, []byte(envContent), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	for _, jobs := range []int{1, 4} {
+		r := newResolver(defaultCommandExecutor)
+		r.setJobs(jobs)
+		actualMap, err := r.parseEnvFile(envFile, map[string]string{})
+		if err != nil {
+			t.Fatalf("parseEnvFile returned error: %v", err)
+		}
+		got := []string{actualMap["A"], actualMap["B"], actualMap["C"], actualMap["D"]}
+		if expected := []string{"s3cret", "other", "", "s3cret"}; !reflect.DeepEqual(got, expected) {
+			t.Errorf("With %d jobs, expected A, B, C, D to be %q, Got %q", jobs, expected, got)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchDebounce is how long changes must settle before the environment is
+	// resolved again, so that an editor saving a file in several steps, or
+	// several files at once, restarts the child only once.
+	watchDebounce = 300 * time.Millisecond
+
+	// watchKillGrace is how long the child is given to exit after SIGTERM on
+	// a restart, before it is sent SIGKILL.
+	watchKillGrace = 5 * time.Second
+
+	// watchPollInterval is how often files are checked for changes where
+	// inotify is not available.
+	watchPollInterval = 500 * time.Millisecond
+)
+
+// fileWatcher reports changes to a set of files.
+type fileWatcher interface {
+	// Changes receives a value after one or more of the files changed.
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// newFileWatcher watches paths with inotify where available, and by polling
+// otherwise.
+func newFileWatcher(paths []string) fileWatcher {
+	if w, err := newInotifyWatcher(paths); err == nil {
+		return w
+	}
+	return newPollWatcher(paths, watchPollInterval)
+}
+
+// pollWatcher is the fileWatcher that compares the size and modification time
+// of the files at a fixed interval.
+type pollWatcher struct {
+	changes chan struct{}
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// fileState is what pollWatcher compares; the zero value for missing files.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func newPollWatcher(paths []string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{changes: make(chan struct{}, 1), stop: make(chan struct{})}
+	states := pollFileStates(paths)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.stop:
+				return
+			}
+			current := pollFileStates(paths)
+			if !reflect.DeepEqual(current, states) {
+				states = current
+				select {
+				case w.changes <- struct{}{}:
+				default: // A change is pending already.
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func pollFileStates(paths []string) map[string]fileState {
+	states := make(map[string]fileState, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			states[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		}
+	}
+	return states
+}
+
+func (w *pollWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	w.once.Do(func() { close(w.stop) })
+	return nil
+}
+
+// watchSession implements --watch: it runs the child under the resolved
+// environment and restarts it whenever a .env file, or a file read by a
+// `${secret:file:...}` reference, changes.
+type watchSession struct {
+	name string // The executable, for messages.
+
+	// resolve resolves the environment, with a new resolver every time so
+	// that nothing stale is memoized.
+	resolve func(ctx context.Context) (resolvedEnv, error)
+	// launch starts the child under env.
+	launch func(env resolvedEnv) (*supervisor, error)
+}
+
+// run runs the child until ctx is done (e.g., on Ctrl-C), starting with the
+// already resolved env. A child that exits on its own is started again after
+// the next change. It returns setnv's exit status.
+func (w *watchSession) run(ctx context.Context, env resolvedEnv) int {
+	child, err := w.launch(env)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, " » setnv: Error executing '%s': %v\n", w.name, err)
+		return 1
+	}
+	watcher := newFileWatcher(env.paths)
+	defer func() { watcher.Close() }()
+	fmt.Fprintf(os.Stderr, " » setnv: Watching %s for changes.\n", strings.Join(env.paths, ", "))
+
+	for {
+		var childExited <-chan struct{} // Nil, and never ready, without a child.
+		if child != nil {
+			childExited = child.exited()
+		}
+
+		select {
+		case <-ctx.Done():
+			if child != nil {
+				child.stop(watchKillGrace)
+			}
+			return 130 // The conventional exit status after SIGINT.
+		case <-childExited:
+			status, _ := child.wait()
+			fmt.Fprintf(os.Stderr, " » setnv: '%s' exited with status %d; waiting for changes to restart it.\n", w.name, status)
+			child = nil
+			continue
+		case <-watcher.Changes():
+		}
+
+		if !debounce(ctx, watcher.Changes(), watchDebounce) {
+			continue // Interrupted; handled above.
+		}
+		newEnv, err := w.resolve(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, " » setnv: Error parsing .env file: %v\n » setnv: Keeping the current environment.\n", err)
+			}
+			continue
+		}
+		changes := describeEnvChanges(env.vars, newEnv.vars)
+		if !reflect.DeepEqual(newEnv.fileKeys, env.fileKeys) {
+			changes = strings.TrimPrefix(changes+"; changed the variables delivered as files", "; ")
+		}
+		if changes == "" && child != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: No variables changed; '%s' keeps running.\n", w.name)
+			continue
+		}
+		if changes == "" {
+			changes = "no variables changed"
+		}
+		fmt.Fprintf(os.Stderr, " » setnv: Environment changed (%s); restarting '%s'.\n", changes, w.name)
+
+		if child != nil {
+			child.stop(watchKillGrace)
+		}
+		if !reflect.DeepEqual(newEnv.paths, env.paths) {
+			watcher.Close()
+			watcher = newFileWatcher(newEnv.paths)
+		}
+		env = newEnv
+		if child, err = w.launch(env); err != nil {
+			fmt.Fprintf(os.Stderr, " » setnv: Error executing '%s': %v\n", w.name, err)
+			child = nil
+		}
+	}
+}
+
+// debounce waits until no change has been received on changes for quiet. It
+// reports false if ctx is done first.
+func debounce(ctx context.Context, changes <-chan struct{}, quiet time.Duration) bool {
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case <-changes:
+			timer.Reset(quiet)
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// describeEnvChanges summarizes which variables were added, removed, or
+// changed from before to after, e.g. "added PORT; changed DB_PASS". Values
+// are never included. It returns "" if nothing changed.
+func describeEnvChanges(before, after map[string]string) string {
+	var added, removed, changed []string
+	for key, value := range after {
+		if old, ok := before[key]; !ok {
+			added = append(added, key)
+		} else if old != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	var parts []string
+	for _, group := range []struct {
+		verb string
+		keys []string
+	}{{"added", added}, {"removed", removed}, {"changed", changed}} {
+		if len(group.keys) > 0 {
+			sort.Strings(group.keys)
+			parts = append(parts, group.verb+" "+strings.Join(group.keys, ", "))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// recordSecretFile records that path is read by a `${secret:file:...}` reference.
+func (r *resolver) recordSecretFile(path string) {
+	r.secretFilePathsMu.Lock()
+	defer r.secretFilePathsMu.Unlock()
+	r.secretFilePaths[path] = true
+}
+
+// secretFiles returns the files read by `${secret:file:...}` references.
+func (r *resolver) secretFiles() []string {
+	r.secretFilePathsMu.Lock()
+	defer r.secretFilePathsMu.Unlock()
+	var paths []string
+	for path := range r.secretFilePaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// watchedPaths returns the files the environment was resolved from: the .env
+// files and the files read by `${secret:file:...}` references.
+func watchedPaths(envFilePaths []string, r *resolver) []string {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, path := range append(append([]string{}, envFilePaths...), r.secretFiles()...) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
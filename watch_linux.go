@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask selects the events that may change a watched file: writes, and
+// editors or secret mounts replacing the file by a rename.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// inotifyWatcher is the fileWatcher based on Linux inotify. It watches the
+// directories of the files, so that files replaced by a rename are noticed.
+type inotifyWatcher struct {
+	file    *os.File
+	dirs    map[int32]string // Watched directory by watch descriptor.
+	paths   map[string]bool
+	changes chan struct{}
+}
+
+func newInotifyWatcher(paths []string) (fileWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"), // Non-blocking, so Close interrupts reads.
+		dirs:    make(map[int32]string),
+		paths:   make(map[string]bool),
+		changes: make(chan struct{}, 1),
+	}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		w.paths[path] = true
+		dir := filepath.Dir(path)
+		wd, err := syscall.InotifyAddWatch(fd, dir, inotifyMask)
+		if err != nil {
+			w.file.Close()
+			return nil, err
+		}
+		w.dirs[int32(wd)] = dir
+	}
+	go w.read()
+	return w, nil
+}
+
+// read reports the events on watched files until the watcher is closed.
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			if dir, ok := w.dirs[event.Wd]; ok && w.paths[filepath.Join(dir, name)] {
+				select {
+				case w.changes <- struct{}{}:
+				default: // A change is pending already.
+				}
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
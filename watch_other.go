@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// newInotifyWatcher is only available on Linux; elsewhere, files are polled.
+func newInotifyWatcher(paths []string) (fileWatcher, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
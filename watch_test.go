@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDescribeEnvChanges checks the summary of changed variables on a restart.
+func TestDescribeEnvChanges(t *testing.T) {
+	tests := []struct {
+		before, after map[string]string
+		expected      string
+	}{
+		{map[string]string{"A": "1"}, map[string]string{"A": "1"}, ""},
+		{map[string]string{"A": "1"}, map[string]string{"A": "2"}, "changed A"},
+		{
+			map[string]string{"A": "1", "B": "1", "D": "1"},
+			map[string]string{"A": "2", "C": "1", "E": "1", "D": "1"},
+			"added C, E; removed B; changed A",
+		},
+	}
+	for _, tt := range tests {
+		if got := describeEnvChanges(tt.before, tt.after); got != tt.expected {
+			t.Errorf("describeEnvChanges(%v, %v) = %q, expected %q", tt.before, tt.after, got, tt.expected)
+		}
+	}
+}
+
+// expectChange fails the test unless w reports a change within a second.
+func expectChange(t *testing.T, w fileWatcher, what string) {
+	t.Helper()
+	select {
+	case <-w.Changes():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a change after %s", what)
+	}
+}
+
+// TestFileWatchers checks that both watchers notice files being written,
+// replaced by a rename (as editors save), and removed, but not other files.
+func TestFileWatchers(t *testing.T) {
+	watchers := map[string]func([]string) (fileWatcher, error){
+		"inotify": newInotifyWatcher,
+		"poll": func(paths []string) (fileWatcher, error) {
+			return newPollWatcher(paths, 10*time.Millisecond), nil
+		},
+	}
+	for name, newWatcher := range watchers {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			envFile := filepath.Join(dir, "dev.env")
+			if err := ioutil.WriteFile(envFile, []byte("A=1\n"), 0600); err != nil {
+				t.Fatalf("Failed to write env file: %v", err)
+			}
+			w, err := newWatcher([]string{envFile})
+			if err != nil {
+				t.Skipf("%s watcher not available: %v", name, err)
+			}
+			defer w.Close()
+
+			if err := ioutil.WriteFile(filepath.Join(dir, "other.env"), []byte("B=1\n"), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			select {
+			case <-w.Changes():
+				t.Fatalf("Expected no change for an unwatched file")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			if err := ioutil.WriteFile(envFile, []byte("A=22\n"), 0600); err != nil {
+				t.Fatalf("Failed to write env file: %v", err)
+			}
+			expectChange(t, w, "a write")
+
+			tmp := filepath.Join(dir, ".dev.env.swp")
+			if err := ioutil.WriteFile(tmp, []byte("A=333\n"), 0600); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			if err := os.Rename(tmp, envFile); err != nil {
+				t.Fatalf("Failed to rename file: %v", err)
+			}
+			expectChange(t, w, "a rename")
+
+			if err := os.Remove(envFile); err != nil {
+				t.Fatalf("Failed to remove env file: %v", err)
+			}
+			expectChange(t, w, "a removal")
+		})
+	}
+}
+
+// TestWatchSessionRestarts checks that the child is restarted when the
+// resolved variables change, but not when they stay the same.
+func TestWatchSessionRestarts(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "dev.env")
+	if err := ioutil.WriteFile(envFile, []byte("A=1\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+
+	var mu sync.Mutex
+	var launched []string
+	session := &watchSession{
+		name: "sleep",
+		resolve: func(ctx context.Context) (resolvedEnv, error) {
+			r := newResolver(defaultCommandExecutor)
+			vars, err := resolveEnvFiles(r, []string{envFile}, nil, map[string]string{})
+			return resolvedEnv{vars: vars, paths: []string{envFile}}, err
+		},
+		launch: func(env resolvedEnv) (*supervisor, error) {
+			mu.Lock()
+			launched = append(launched, env.vars["A"])
+			mu.Unlock()
+			child := newSupervisor("/bin/sleep", []string{"sleep", "60"}, nil)
+			return child, child.start()
+		},
+	}
+	initial, err := session.resolve(context.Background())
+	if err != nil {
+		t.Fatalf("resolve returned error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	status := make(chan int)
+	go func() { status <- session.run(ctx, initial) }()
+
+	time.Sleep(200 * time.Millisecond)
+	if err := ioutil.WriteFile(envFile, []byte("A=2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	time.Sleep(watchDebounce + 500*time.Millisecond)
+	if err := ioutil.WriteFile(envFile, []byte("A=2\n# Only a comment changed.\n"), 0600); err != nil {
+		t.Fatalf("Failed to write env file: %v", err)
+	}
+	time.Sleep(watchDebounce + 500*time.Millisecond)
+	cancel()
+
+	if s := <-status; s != 130 {
+		t.Errorf("Expected exit status 130, Got %d", s)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(launched) != 2 || launched[0] != "1" || launched[1] != "2" {
+		t.Errorf("Expected launches with A=1 and A=2, Got %v", launched)
+	}
+}
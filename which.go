@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// absPath returns path as an absolute path, or path itself if that fails.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// runWhichCommand implements `setnv which <id>[,<id2>,...]`: it prints the
+// .env file used for each ID and every path that was considered for it.
+func runWhichCommand(args []string) error {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("usage: setnv which <id>[,<id2>,...]")
+	}
+	var missing []string
+	for _, envID := range strings.Split(args[0], ",") {
+		if envID = strings.TrimSpace(envID); envID == "" {
+			continue
+		}
+		var considered []string
+		envFilePath, err := traceEnvFile(envID, func(path, decision string) {
+			considered = append(considered, fmt.Sprintf("  %s (%s)", absPath(path), decision))
+		})
+		if err != nil {
+			fmt.Printf("%s: %v\n", envID, err)
+			missing = append(missing, envID)
+		} else {
+			fmt.Printf("%s: %s\n", envID, absPath(envFilePath))
+		}
+		for _, line := range considered {
+			fmt.Println(line)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no .env file found for %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
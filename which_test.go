@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestTraceEnvFile checks that tracing reports every path in order of
+// preference, including those shadowed by the file found.
+func TestTraceEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("SETNV_CONFIG_DIR", dir)
+	for _, name := range envFileNames("setnv-trace-test") {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("A=1\n"), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	var trace []string
+	envFilePath, err := traceEnvFile("setnv-trace-test", func(path, decision string) {
+		trace = append(trace, path+": "+decision)
+	})
+	used := filepath.Join(dir, "setnv-trace-test.env")
+	if err != nil || envFilePath != used {
+		t.Fatalf("traceEnvFile() = %q, %v; expected %q", envFilePath, err, used)
+	}
+	expected := []string{
+		"setnv-trace-test.env: not found",
+		"setnv-trace-test.env.age: not found",
+		used + ": found, using it",
+		used + ".age: found, but shadowed by '" + used + "'",
+	}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Errorf("Expected trace %q, Got %q", expected, trace)
+	}
+}